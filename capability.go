@@ -0,0 +1,214 @@
+package transform
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// 单次探测 ffmpeg 的最长时间
+const probeTimeout = 10 * time.Second
+
+// ffmpeg 能力集，启动时探测一次并缓存
+type FfmpegCapability struct {
+	Path          string    `json:"path"`
+	Version       string    `json:"version"`
+	Encoders      []string  `json:"encoders"`      //视频编码器
+	AudioEncoders []string  `json:"audioEncoders"` //音频编码器
+	Filters       []string  `json:"filters"`
+	Error         string    `json:"error,omitempty"`
+	Time          time.Time `json:"time"`
+
+	encoders map[string]bool
+	filters  map[string]bool
+}
+
+var (
+	ffmpegCaps     *FfmpegCapability
+	ffmpegCapsLock sync.RWMutex
+)
+
+func getFfmpegCapability() *FfmpegCapability {
+	ffmpegCapsLock.RLock()
+	defer ffmpegCapsLock.RUnlock()
+	return ffmpegCaps
+}
+
+// 探测并缓存 ffmpeg 能力集
+func (t *TransformConfig) probeFfmpeg() *FfmpegCapability {
+	caps := probeFfmpeg(t.Ffmpeg)
+	if caps.Error != "" {
+		TransformPlugin.Error("ffmpeg probe faild", zap.String("ffmpeg", t.Ffmpeg), zap.String("error", caps.Error))
+	} else {
+		TransformPlugin.Info("ffmpeg probe", zap.String("ffmpeg", t.Ffmpeg), zap.String("version", caps.Version),
+			zap.Int("encoders", len(caps.Encoders)), zap.Int("filters", len(caps.Filters)))
+	}
+	ffmpegCapsLock.Lock()
+	ffmpegCaps = caps
+	ffmpegCapsLock.Unlock()
+	return caps
+}
+
+func probeFfmpeg(path string) *FfmpegCapability {
+	caps := &FfmpegCapability{
+		Path:     path,
+		Time:     time.Now(),
+		encoders: make(map[string]bool),
+		filters:  make(map[string]bool),
+	}
+
+	out, err := runProbe(path, "-version")
+	if err != nil {
+		caps.Error = err.Error()
+		return caps
+	}
+	//ffmpeg version 6.0 Copyright (c) 2000-2023 the FFmpeg developers
+	if fields := strings.Fields(firstLine(out)); len(fields) > 2 && fields[1] == "version" {
+		caps.Version = fields[2]
+	}
+
+	if out, err = runProbe(path, "-encoders"); err != nil {
+		caps.Error = err.Error()
+		return caps
+	}
+	// V....D libx264              libx264 H.264 / AVC / MPEG-4 AVC / MPEG-4 part 10 (codec h264)
+	listed := false
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if !listed {
+			listed = len(fields) > 0 && strings.HasPrefix(fields[0], "---")
+			continue
+		}
+		if len(fields) < 2 {
+			continue
+		}
+		switch {
+		case strings.HasPrefix(fields[0], "V"):
+			caps.encoders[fields[1]] = true
+			caps.Encoders = append(caps.Encoders, fields[1])
+		case strings.HasPrefix(fields[0], "A"):
+			caps.encoders[fields[1]] = true
+			caps.AudioEncoders = append(caps.AudioEncoders, fields[1])
+		}
+	}
+
+	if out, err = runProbe(path, "-filters"); err != nil {
+		caps.Error = err.Error()
+		return caps
+	}
+	// T.C drawtext          V->V       Draw text on top of video frames using libfreetype library.
+	scanner = bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) > 2 && strings.Contains(fields[2], "->") {
+			caps.filters[fields[1]] = true
+			caps.Filters = append(caps.Filters, fields[1])
+		}
+	}
+	return caps
+}
+
+func runProbe(path string, arg string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), probeTimeout)
+	defer cancel()
+	out, err := exec.CommandContext(ctx, path, "-hide_banner", arg).Output()
+	if err != nil {
+		return nil, fmt.Errorf("%s %s: %w", path, arg, err)
+	}
+	return out, nil
+}
+
+func firstLine(out []byte) string {
+	if i := bytes.IndexByte(out, '\n'); i >= 0 {
+		out = out[:i]
+	}
+	return string(out)
+}
+
+func (caps *FfmpegCapability) HasEncoder(name string) bool {
+	return caps.encoders[name]
+}
+
+func (caps *FfmpegCapability) HasFilter(name string) bool {
+	return caps.filters[name]
+}
+
+// 按能力集校验任务，编码器不可用时按 codecfallback 依次替换
+// 未探测过能力集或不使用 ffmpeg 转码时不做校验
+func (t *TransformConfig) checkCapability(config *StreamConfig) error {
+	caps := getFfmpegCapability()
+	if caps == nil || (t.Backend != "" && t.Backend != "ffmpeg") {
+		return nil
+	}
+	if caps.Error != "" {
+		return fmt.Errorf("ffmpeg not available: %s", caps.Error)
+	}
+
+	if !caps.HasEncoder(config.VideoCodec) {
+		codec := ""
+		for _, fallback := range t.CodecFallback {
+			if caps.HasEncoder(fallback) {
+				codec = fallback
+				break
+			}
+		}
+		if codec == "" {
+			return fmt.Errorf("video encoder %s not supported by %s", config.VideoCodec, caps.Path)
+		}
+		TransformPlugin.Warn("video encoder fallback", zap.String("videoCodec", config.VideoCodec), zap.String("fallback", codec))
+		config.VideoCodec = codec
+	}
+
+	commands := []*ffmpegCommand{t.ffmpegCommand(config)}
+	if config.Slate != nil {
+		commands = append(commands, t.slateCommand(config))
+	}
+	for _, command := range commands {
+		//命令实际使用的编码器，包括音频和各类型固定的编码器
+		for _, encoder := range commandEncoders(command.Args) {
+			if !caps.HasEncoder(encoder) {
+				return fmt.Errorf("encoder %s not supported by %s", encoder, caps.Path)
+			}
+		}
+		for _, name := range command.Filter.Names() {
+			if !caps.HasFilter(name) {
+				return fmt.Errorf("filter %s not supported by %s", name, caps.Path)
+			}
+		}
+	}
+	return nil
+}
+
+// 命令参数中指定的编码器，copy 不算
+func commandEncoders(args []string) []string {
+	var encoders []string
+	for i := 0; i+1 < len(args); i++ {
+		switch args[i] {
+		case "-c:v", "-vcodec", "-c:a", "-acodec", "-codec:v", "-codec:a":
+			if args[i+1] != "copy" {
+				encoders = append(encoders, args[i+1])
+			}
+		}
+	}
+	return encoders
+}
+
+// /transform/capability 返回缓存的 ffmpeg 能力集，refresh=1 时重新探测
+func (t *TransformConfig) Capability(w http.ResponseWriter, r *http.Request) {
+	caps := getFfmpegCapability()
+	if caps == nil || r.URL.Query().Get("refresh") == "1" {
+		caps = t.probeFfmpeg()
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(caps)
+}
@@ -0,0 +1,278 @@
+package transform
+
+import (
+	"fmt"
+	"math"
+	"runtime"
+	"strconv"
+)
+
+// 生成的 ffmpeg 命令
+type ffmpegCommand struct {
+	Args          []string     //不含可执行文件路径
+	Filter        *filterGraph //视频滤镜图，输入为 [0:v]
+	FilterOutputs []string     //滤镜图的视频输出 pad
+	PipeIn        bool         //从标准输入读取订阅的裸流
+	PipeOuts      int          //ts 流输出管道数，第一路为标准输出，其余依次为 fd 3 4 ...
+	ExtraIns      int          //附加输入管道数，fd 接在输出管道之后
+}
+
+// 按转码类型生成 ffmpeg 参数
+func (t *TransformConfig) ffmpegCommand(config *StreamConfig) *ffmpegCommand {
+	if config.slateActive {
+		return t.slateCommand(config)
+	}
+	switch config.TransType {
+	case TransTypeRtsp:
+		return t.ffmpegCommand1(config)
+	case TransTypeRtmp:
+		return t.ffmpegCommand2(config)
+	case TransTypeLadder:
+		return t.ffmpegCommand3(config)
+	case TransTypePtz, TransTypePip, TransTypePull, TransTypeFile:
+		return t.ffmpegCommand0(config)
+	case TransTypeMosaic:
+		return t.ffmpegCommand6(config)
+	default:
+		return t.ffmpegCommand0(config)
+	}
+}
+
+// 转码后的 ts 流地址，与 ffmpeg 输出管道一一对应，直接推流时为空
+func outputStreamPaths(config *StreamConfig) []string {
+	if config.PushOnly {
+		return nil
+	}
+	switch config.TransType {
+	case TransTypeRtsp, TransTypeRtmp:
+		return nil
+	case TransTypeLadder:
+		paths := make([]string, len(config.Renditions))
+		for i, r := range config.Renditions {
+			paths[i] = config.NewStreamPath + "/" + r.Name
+		}
+		return paths
+	default:
+		return []string{config.NewStreamPath}
+	}
+}
+
+// 第 i 路 ts 输出管道，第一路为标准输出，其余从 fd 3 开始
+func pipeOut(i int) string {
+	if i == 0 {
+		return "pipe:1"
+	}
+	return fmt.Sprintf("pipe:%d", i+2)
+}
+
+// os/exec 在 windows 上不支持 ExtraFiles，fd 3 起的管道无法交给 ffmpeg
+var extraPipesSupported = runtime.GOOS != "windows"
+
+// 需要 fd 3 起的输出或输入管道的任务，不支持时在校验时拒绝，避免每次重启都启动失败
+func checkExtraPipes(config *StreamConfig) error {
+	if !extraPipesSupported {
+		return fmt.Errorf("transtype %d needs extra pipes, not supported on %s", config.TransType, runtime.GOOS)
+	}
+	return nil
+}
+
+// 全局参数，进度以 key=value 写到标准错误
+func globalArgs() []string {
+	return []string{"-hide_banner", "-nostats", "-progress", "pipe:2"}
+}
+
+// 滤镜图的参数，映射滤镜输出和可能存在的音频
+func filterArgs(g *filterGraph) []string {
+	return []string{
+		"-filter_complex", g.String(),
+		"-map", "[vout]",
+		"-map", "0:a?",
+	}
+}
+
+// osd 文字叠加
+func (t *TransformConfig) osdFilter(g *filterGraph, config *StreamConfig) {
+	if config.OsdText == "" && !config.OsdLive {
+		return
+	}
+	//"drawtext=fontsize=100:fontfile=shoujin.ttf:text='m7s转码 ts2':x=500:y=500:fontcolor=green:box=1:boxcolor=yellow",
+	boxcolor := ""
+	if config.OsdBox != 0 {
+		boxcolor = config.OsdBoxcolor
+	}
+	if config.OsdLive {
+		//文字从文件读取，文件由任务在 ffmpeg 启动前写好
+		g.Filter("drawtext", drawtextRawArgs(t.Fontfile, config.OsdFontsize, drawtextFile(t.osdFile(config)),
+			strconv.Itoa(config.OsdX), strconv.Itoa(config.OsdY), config.OsdFontColor, boxcolor)...)
+		return
+	}
+	g.Filter("drawtext", drawtextArgs(t.Fontfile, config.OsdFontsize, config.OsdText,
+		config.OsdX, config.OsdY, config.OsdFontColor, boxcolor)...)
+}
+
+// 单路输出的视频滤镜：增强、安装方向、遮挡、云台、osd、缩放、画中画、文字层、滚动字幕、台标
+func (t *TransformConfig) videoFilters(config *StreamConfig) *filterGraph {
+	g := newFilterGraph("0:v")
+	enhanceFilter(g, config)
+	stabilizeFilter(g, config)
+	orientFilter(g, config)
+	maskFilter(g, config)
+	if config.TransType == TransTypePtz {
+		ptzFilter(g, config)
+	}
+	t.osdFilter(g, config)
+	res, _ := parseResolution(config.Resolution)
+	g.Append(res.scaleFilters(g, config.Pad)...)
+	if config.TransType == TransTypePip {
+		t.pipFilter(g, config)
+	}
+	g.Append(t.textFilters(g, config)...)
+	g.Append(t.tickerFilters(g, config)...)
+	t.logoFilter(g, config)
+	g.Output("vout")
+	return g
+}
+
+// 订阅裸流从管道输入（拉取外部地址、循环播放文件时由 ffmpeg 直接读取），转码后 ts 流从管道输出
+func (t *TransformConfig) ffmpegCommand0(config *StreamConfig) *ffmpegCommand {
+	g := t.videoFilters(config)
+	args := append(globalArgs(), "-re",
+		"-i", "pipe:0",
+	)
+	//外部地址和文件的音频不一定能放进 ts，统一转为 aac
+	acodec := "copy"
+	switch config.TransType {
+	case TransTypePull:
+		args = append(globalArgs(), t.pullInputArgs(config)...)
+		acodec = "aac"
+	case TransTypeFile:
+		args = append(globalArgs(), t.fileInputArgs(config)...)
+		acodec = "aac"
+	}
+	outArgs, pipeOuts := outputArgs(config)
+	extraArgs, extraIns := extraInputArgs(config, pipeOuts)
+	args = append(args, extraArgs...)
+	args = append(args, filterArgs(g)...)
+	args = append(args, videoEncodeArgs(config)...)
+	args = append(args, "-acodec", acodec)
+	args = append(args, outArgs...)
+	return &ffmpegCommand{Args: args, Filter: g, FilterOutputs: []string{"vout"}, PipeIn: config.TransType != TransTypePull && config.TransType != TransTypeFile, PipeOuts: pipeOuts, ExtraIns: extraIns}
+}
+
+// 单路输出的视频编码参数
+func videoEncodeArgs(config *StreamConfig) []string {
+	args := []string{
+		"-tune", "zerolatency", //编码延迟参数
+		//"-g", "12", "-keyint_min", "12", //设置GOP 大小和关键帧间隔
+		//"-preset", "superfast", //编码延迟参数，superfast ultrafast  影响图像质量
+		"-r", config.Fps,
+		"-c:v", config.VideoCodec,
+	}
+	if config.Bitrate != "" {
+		args = append(args, "-b:v", config.Bitrate)
+	}
+	return args
+}
+
+// 拉取本机 rtsp 流，转码后推送到本机 rtmp
+func (t *TransformConfig) ffmpegCommand1(config *StreamConfig) *ffmpegCommand {
+	//ffmpeg -ss 0:01 -i "rtsp://127.0.0.1:554/njtv/glgc" -vcodec copy  -vcodec libx264 -s 720*576 -f flv "rtmp://127.0.0.1:1935/njtv/glgc-d1"
+	pullpath := "rtsp://127.0.0.1:554/" + config.StreamPath
+	tspath := "rtmp://127.0.0.1:1935/" + config.NewStreamPath
+
+	g := t.videoFilters(config)
+	args := append(globalArgs(), "-re",
+		"-i", pullpath,
+	)
+	args = append(args, filterArgs(g)...)
+	args = append(args, rtmpVideoArgs(config, tspath)...)
+	return &ffmpegCommand{Args: args, Filter: g, FilterOutputs: []string{"vout"}}
+}
+
+// 订阅裸流从管道输入，转码后推送到本机 rtmp
+func (t *TransformConfig) ffmpegCommand2(config *StreamConfig) *ffmpegCommand {
+	g := t.videoFilters(config)
+	args := append(globalArgs(), "-re",
+		"-i", "pipe:0",
+	)
+	args = append(args, filterArgs(g)...)
+	args = append(args, rtmpVideoArgs(config, "rtmp://127.0.0.1:1935/"+config.NewStreamPath)...)
+	return &ffmpegCommand{Args: args, Filter: g, FilterOutputs: []string{"vout"}, PipeIn: true}
+}
+
+// 推送 rtmp 的编码参数，未配置码率时为 400k
+func rtmpVideoArgs(config *StreamConfig, url string) []string {
+	bitrate := config.Bitrate
+	if bitrate == "" {
+		bitrate = "400k"
+	}
+	return []string{
+		"-tune", "zerolatency", //编码延迟参数
+		"-vcodec", config.VideoCodec,
+		"-g", "12", "-keyint_min", "12", //设置GOP 大小和关键帧间隔
+		"-b:v", bitrate,
+		"-preset", "superfast", //编码延迟参数，superfast ultrafast  影响图像质量
+		"-r", config.Fps,
+		"-acodec", "aac",
+		"-b:a", "64k",
+		"-f",
+		"flv",
+		url,
+	}
+}
+
+// 多码率阶梯的关键帧间隔，秒
+const ladderGopSeconds = 2
+
+// 一次解码，split 后按各档分辨率缩放编码，每档一路 ts 输出
+// 先统一帧率再 split，各档关键帧位置一致，播放器可以无缝切换
+func (t *TransformConfig) ffmpegCommand3(config *StreamConfig) *ffmpegCommand {
+	g := newFilterGraph("0:v")
+	enhanceFilter(g, config)
+	stabilizeFilter(g, config)
+	orientFilter(g, config)
+	maskFilter(g, config)
+	t.osdFilter(g, config)
+	t.logoFilter(g, config)
+	g.Filter("fps", config.Fps)
+	splits := g.Split(len(config.Renditions))
+
+	fps, _ := strconv.ParseFloat(config.Fps, 64)
+	gop := strconv.Itoa(int(math.Round(fps * ladderGopSeconds)))
+
+	var outputs []string
+	var outputArgs []string
+	for i, r := range config.Renditions {
+		out := g.Label("r")
+		res, _ := parseResolution(r.Resolution)
+		//文字层在各档缩放之后叠加，大小一致
+		filters := append(res.scaleFilters(g, config.Pad), t.textFilters(g, config)...)
+		filters = append(filters, t.tickerFilters(g, config)...)
+		g.Chain([]string{splits[i]}, []string{out}, filters...)
+		outputs = append(outputs, out)
+
+		outputArgs = append(outputArgs,
+			"-map", "["+out+"]",
+			"-map", "0:a?",
+			"-c:v", config.VideoCodec,
+			"-tune", "zerolatency", //编码延迟参数
+		)
+		if r.Bitrate != "" {
+			outputArgs = append(outputArgs, "-b:v", r.Bitrate)
+		}
+		outputArgs = append(outputArgs,
+			"-g", gop, "-keyint_min", gop, "-sc_threshold", "0",
+			"-force_key_frames", fmt.Sprintf("expr:gte(t,n_forced*%d)", ladderGopSeconds),
+			"-acodec", "copy",
+			"-f", "mpegts",
+			pipeOut(i),
+		)
+	}
+
+	args := append(globalArgs(), "-re",
+		"-i", "pipe:0",
+		"-filter_complex", g.String(),
+	)
+	args = append(args, outputArgs...)
+	return &ffmpegCommand{Args: args, Filter: g, FilterOutputs: outputs, PipeIn: true, PipeOuts: len(outputs)}
+}
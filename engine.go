@@ -0,0 +1,68 @@
+package transform
+
+import (
+	"io"
+
+	"go.uber.org/zap"
+	. "m7s.live/engine/v4"
+)
+
+// 任务在引擎上订阅源流、发布转码流，测试时换成进程内的实现
+type streamEngine interface {
+	// 订阅源流，成功后由 Play 读取
+	Subscribe(streamPath string, s *TransformSubscriber) error
+	// 读取订阅的裸流交给 s.OnEvent，订阅结束后返回
+	Play(s *TransformSubscriber)
+	// 结束订阅
+	Unsubscribe(s *TransformSubscriber, reason string)
+	// 发布转码流，成功后写入 p.pw 的 ts 流由引擎读取
+	Publish(streamPath string, p *TransformPublisher) error
+	// 结束发布，p.pw 已关闭
+	Unpublish(p *TransformPublisher)
+}
+
+var taskEngine streamEngine = m7sEngine{}
+
+// 插件所在的 m7s 引擎
+type m7sEngine struct{}
+
+func (m7sEngine) Subscribe(streamPath string, s *TransformSubscriber) error {
+	return TransformPlugin.Subscribe(streamPath, s)
+}
+
+func (m7sEngine) Play(s *TransformSubscriber) {
+	//避免重复请求播放
+	if !s.IsPlaying() {
+		s.PlayRaw()
+	}
+}
+
+func (m7sEngine) Unsubscribe(s *TransformSubscriber, reason string) {
+	s.Stop(zap.String("reason", reason))
+}
+
+func (m7sEngine) Publish(streamPath string, p *TransformPublisher) error {
+	//判断流是否存在，存在则删除重新发布
+	if s := Streams.Get(streamPath); s != nil {
+		Streams.Delete(streamPath)
+	}
+	if err := TransformPlugin.Publish(streamPath, p); err != nil {
+		return err
+	}
+	p.AudioTrack = nil
+	p.VideoTrack = nil
+
+	p.tsReader = NewTSReader(&p.TSPublisher)
+	pr, pw := io.Pipe()
+	p.pw = pw
+	p.TSPublisher.SetIO(pr)
+	go p.feed(pr)
+	return nil
+}
+
+func (m7sEngine) Unpublish(p *TransformPublisher) {
+	p.Stop()
+	if p.tsReader != nil {
+		p.tsReader.Close()
+	}
+}
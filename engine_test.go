@@ -0,0 +1,172 @@
+package transform
+
+import (
+	"bytes"
+	"encoding/hex"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"m7s.live/engine/v4/codec"
+	"m7s.live/engine/v4/track"
+)
+
+// 合成的 H.264：1280x720 25fps 的 SPS、PPS 和一个 IDR 帧，都带起始码
+var (
+	syntheticSPS, _ = hex.DecodeString("6764001fac2ca4014016ec04400000fa000030d43800001e848000186a02ef2e0fa489")
+	syntheticPPS    = []byte{0x68, 0xeb, 0x8f, 0x2c}
+	syntheticIDR    = append([]byte{0, 0, 0, 1, 0x65, 0x88, 0x84, 0x00}, bytes.Repeat([]byte{0x0a, 0x0d, 0x00}, 60)...)
+)
+
+func annexB(nal []byte) []byte {
+	return append([]byte{0, 0, 0, 1}, nal...)
+}
+
+func syntheticTrack() *track.Video {
+	v := &track.Video{}
+	v.CodecID = codec.CodecID_H264
+	v.ParamaterSets = [][]byte{syntheticSPS, syntheticPPS}
+	return v
+}
+
+// 进程内的假引擎：订阅到的源流是合成的 H.264，每 10ms 一帧；发布的转码流记录收到的 ts 数据
+type fakeEngine struct {
+	mu         sync.Mutex
+	subscribes int                                    //Subscribe 次数
+	playing    map[*TransformSubscriber]chan struct{} //订阅结束时关闭
+	published  map[string]*fakePublication            //发布地址 → 最近一次发布
+	publishes  map[string]int                         //各地址发布次数
+}
+
+type fakePublication struct {
+	data    bytes.Buffer
+	stopped bool //Unpublish 后为 true
+	drained chan struct{}
+}
+
+func useFakeEngine(t *testing.T) *fakeEngine {
+	e := &fakeEngine{
+		playing:   make(map[*TransformSubscriber]chan struct{}),
+		published: make(map[string]*fakePublication),
+		publishes: make(map[string]int),
+	}
+	old := taskEngine
+	taskEngine = e
+	t.Cleanup(func() { taskEngine = old })
+	return e
+}
+
+func (e *fakeEngine) Subscribe(streamPath string, s *TransformSubscriber) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.subscribes++
+	e.playing[s] = make(chan struct{})
+	return nil
+}
+
+// 先给出带 SPS PPS 的视频轨道，再持续送 IDR 帧
+func (e *fakeEngine) Play(s *TransformSubscriber) {
+	e.mu.Lock()
+	done := e.playing[s]
+	e.mu.Unlock()
+	s.OnEvent(syntheticTrack())
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			s.writeAnnexB(net.Buffers{syntheticIDR})
+		}
+	}
+}
+
+func (e *fakeEngine) Unsubscribe(s *TransformSubscriber, reason string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if done := e.playing[s]; done != nil {
+		close(done)
+		delete(e.playing, s)
+	}
+}
+
+func (e *fakeEngine) Publish(streamPath string, p *TransformPublisher) error {
+	pub := &fakePublication{drained: make(chan struct{})}
+	pr, pw := io.Pipe()
+	p.pw = pw
+	e.mu.Lock()
+	e.published[streamPath] = pub
+	e.publishes[streamPath]++
+	e.mu.Unlock()
+	go func() {
+		buf := make([]byte, 4096)
+		for {
+			n, err := pr.Read(buf)
+			e.mu.Lock()
+			pub.data.Write(buf[:n])
+			e.mu.Unlock()
+			if err != nil {
+				close(pub.drained)
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+func (e *fakeEngine) Unpublish(p *TransformPublisher) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if pub := e.published[p.path]; pub != nil {
+		pub.stopped = true
+	}
+}
+
+// 发布地址最近一次发布收到的数据，未发布过为 nil
+func (e *fakeEngine) received(path string) []byte {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if pub := e.published[path]; pub != nil {
+		return append([]byte{}, pub.data.Bytes()...)
+	}
+	return nil
+}
+
+// 正在发布的地址
+func (e *fakeEngine) live(path string) bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	pub := e.published[path]
+	return pub != nil && !pub.stopped
+}
+
+// 发布者的管道已关闭，收到的数据已读完
+func (e *fakeEngine) closed(path string) bool {
+	e.mu.Lock()
+	pub := e.published[path]
+	e.mu.Unlock()
+	if pub == nil {
+		return false
+	}
+	select {
+	case <-pub.drained:
+		return true
+	default:
+		return false
+	}
+}
+
+func (e *fakeEngine) counts() (subscribes, playing int) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.subscribes, len(e.playing)
+}
+
+func (e *fakeEngine) publishCount(path string) int {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.publishes[path]
+}
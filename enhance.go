@@ -0,0 +1,217 @@
+package transform
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+)
+
+// 画质增强，用于模拟编码器送来的隔行、噪点多的画面，各项省略或为零值时不启用
+// 数值项省略为 nil，任务可以显式设为 0 关闭预设中的同名项；去隔行、降噪设为 none 关闭
+type Enhance struct {
+	Deinterlace     string   `yaml:"deinterlace"`     //去隔行 yadif bwdif none
+	DeinterlaceMode int      `yaml:"deinterlacemode"` //0 每帧输出一帧，1 每场输出一帧（帧率加倍）
+	Denoise         string   `yaml:"denoise"`         //降噪 hqdn3d nlmeans none
+	DenoiseStrength *float64 `yaml:"denoisestrength"` //hqdn3d 的空域强度默认 4，nlmeans 的强度默认 1
+	Sharpen         *float64 `yaml:"sharpen"`         //锐化 unsharp 的亮度强度，eg:1.0
+	Brightness      *float64 `yaml:"brightness"`      //亮度 -1~1
+	Contrast        *float64 `yaml:"contrast"`        //对比度，默认 1
+	Saturation      *float64 `yaml:"saturation"`      //饱和度，默认 1
+	Gamma           *float64 `yaml:"gamma"`           //gamma，默认 1
+}
+
+// 不启用增强的项
+const enhanceNone = "none"
+
+// 以 base 为基础，e 中设置了的项覆盖
+func (e *Enhance) merge(base Enhance) Enhance {
+	if e == nil {
+		return base
+	}
+	if e.Deinterlace != "" {
+		base.Deinterlace = e.Deinterlace
+		base.DeinterlaceMode = e.DeinterlaceMode
+	}
+	if e.Denoise != "" {
+		base.Denoise = e.Denoise
+	}
+	for _, f := range []struct{ dst, src **float64 }{
+		{&base.DenoiseStrength, &e.DenoiseStrength},
+		{&base.Sharpen, &e.Sharpen},
+		{&base.Brightness, &e.Brightness},
+		{&base.Contrast, &e.Contrast},
+		{&base.Saturation, &e.Saturation},
+		{&base.Gamma, &e.Gamma},
+	} {
+		if *f.src != nil {
+			*f.dst = *f.src
+		}
+	}
+	return base
+}
+
+// 未设置的数值项为 0，即不启用
+func enhanceValue(v *float64) float64 {
+	if v == nil {
+		return 0
+	}
+	return *v
+}
+
+// {"deinterlace":"yadif","denoise":"hqdn3d","sharpen":0.8}
+func parseEnhance(s string) (*Enhance, error) {
+	var e Enhance
+	if err := json.Unmarshal([]byte(s), &e); err != nil {
+		return nil, fmt.Errorf("invalid enhance: %w", err)
+	}
+	return &e, nil
+}
+
+// 套用增强预设，配置中的 enhance 覆盖预设中的同名项
+func (t *TransformConfig) resolveEnhance(config *StreamConfig) error {
+	if config.EnhanceProfile == "" {
+		return nil
+	}
+	profile, ok := t.EnhanceProfiles[config.EnhanceProfile]
+	if !ok {
+		return fmt.Errorf("enhance profile not found: %s", config.EnhanceProfile)
+	}
+	enhance := config.Enhance.merge(profile)
+	config.Enhance = &enhance
+	return nil
+}
+
+func validateEnhance(e *Enhance) error {
+	switch e.Deinterlace {
+	case "", enhanceNone, "yadif", "bwdif":
+	default:
+		return fmt.Errorf("invalid deinterlace: %s", e.Deinterlace)
+	}
+	if e.DeinterlaceMode != 0 && e.DeinterlaceMode != 1 {
+		return fmt.Errorf("invalid deinterlace mode: %d", e.DeinterlaceMode)
+	}
+	switch e.Denoise {
+	case "", enhanceNone, "hqdn3d", "nlmeans":
+	default:
+		return fmt.Errorf("invalid denoise: %s", e.Denoise)
+	}
+	sharpen, brightness := enhanceValue(e.Sharpen), enhanceValue(e.Brightness)
+	if enhanceValue(e.DenoiseStrength) < 0 || sharpen < 0 || sharpen > 5 || brightness < -1 || brightness > 1 ||
+		enhanceValue(e.Contrast) < 0 || enhanceValue(e.Saturation) < 0 || enhanceValue(e.Gamma) < 0 {
+		return fmt.Errorf("invalid enhance value: sharpen %g brightness %g contrast %g saturation %g gamma %g denoisestrength %g",
+			sharpen, brightness, enhanceValue(e.Contrast), enhanceValue(e.Saturation), enhanceValue(e.Gamma), enhanceValue(e.DenoiseStrength))
+	}
+	return nil
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
+
+// 去隔行、降噪、调色、锐化，在裁剪旋转之前处理原始画面
+func enhanceFilter(g *filterGraph, config *StreamConfig) {
+	e := config.Enhance
+	if e == nil {
+		return
+	}
+	if e.Deinterlace != "" && e.Deinterlace != enhanceNone {
+		g.Filter(e.Deinterlace, fmt.Sprintf("mode=%d", e.DeinterlaceMode))
+	}
+	strength := enhanceValue(e.DenoiseStrength)
+	switch e.Denoise {
+	case "hqdn3d":
+		if strength > 0 {
+			g.Filter("hqdn3d", "luma_spatial="+formatFloat(strength))
+		} else {
+			g.Filter("hqdn3d")
+		}
+	case "nlmeans":
+		if strength > 0 {
+			g.Filter("nlmeans", "s="+formatFloat(strength))
+		} else {
+			g.Filter("nlmeans")
+		}
+	}
+	var eq []string
+	for _, f := range []struct {
+		name  string
+		value float64
+	}{
+		{"brightness", enhanceValue(e.Brightness)},
+		{"contrast", enhanceValue(e.Contrast)},
+		{"saturation", enhanceValue(e.Saturation)},
+		{"gamma", enhanceValue(e.Gamma)},
+	} {
+		if f.value != 0 {
+			eq = append(eq, f.name+"="+formatFloat(f.value))
+		}
+	}
+	if len(eq) > 0 {
+		g.Filter("eq", eq...)
+	}
+	if sharpen := enhanceValue(e.Sharpen); sharpen > 0 {
+		g.Filter("unsharp", "luma_amount="+formatFloat(sharpen))
+	}
+}
+
+// 防抖，使用 deshake 与上一帧比较估计抖动并补偿
+// vidstab 需要先完整分析一遍再变换，不能用于实时流
+type Stabilize struct {
+	Strength int    `yaml:"strength"` //最大补偿位移，像素 1~64，默认 16
+	Edge     string `yaml:"edge"`     //补偿后边缘的填充 blank original clamp mirror（默认）
+}
+
+// {"strength":32,"edge":"clamp"}
+func parseStabilize(s string) (*Stabilize, error) {
+	var stabilize Stabilize
+	if err := json.Unmarshal([]byte(s), &stabilize); err != nil {
+		return nil, fmt.Errorf("invalid stabilize: %w", err)
+	}
+	return &stabilize, nil
+}
+
+func validateStabilize(s *Stabilize) error {
+	if s.Strength < 0 || s.Strength > 64 {
+		return fmt.Errorf("invalid stabilize strength: %d", s.Strength)
+	}
+	switch s.Edge {
+	case "", "blank", "original", "clamp", "mirror":
+	default:
+		return fmt.Errorf("invalid stabilize edge: %s", s.Edge)
+	}
+	return nil
+}
+
+// 在去隔行降噪之后、裁剪旋转之前防抖
+func stabilizeFilter(g *filterGraph, config *StreamConfig) {
+	s := config.Stabilize
+	if s == nil {
+		return
+	}
+	var args []string
+	if s.Strength > 0 {
+		args = append(args, fmt.Sprintf("rx=%d", s.Strength), fmt.Sprintf("ry=%d", s.Strength))
+	}
+	if s.Edge != "" {
+		args = append(args, "edge="+s.Edge)
+	}
+	g.Filter("deshake", args...)
+}
+
+// 防抖状态
+type StabilizeStatus struct {
+	Filter  string  `json:"filter"`
+	Active  bool    `json:"active"`  //ffmpeg 正在运行且滤镜图中有防抖
+	Latency float64 `json:"latency"` //增加的延迟，毫秒，deshake 需要缓存一帧
+}
+
+func stabilizeStatus(config *StreamConfig, running bool) *StabilizeStatus {
+	if config.Stabilize == nil {
+		return nil
+	}
+	status := &StabilizeStatus{Filter: "deshake", Active: running}
+	if fps, err := strconv.ParseFloat(config.Fps, 64); err == nil && fps > 0 {
+		status.Latency = 1000 / fps
+	}
+	return status
+}
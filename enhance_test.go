@@ -0,0 +1,44 @@
+package transform
+
+import "testing"
+
+// 任务的 enhance 覆盖预设，显式的 0 和 none 关闭预设中的同名项，省略的项沿用预设
+func TestEnhanceMerge(t *testing.T) {
+	conf := &TransformConfig{EnhanceProfiles: map[string]Enhance{}}
+	profile, err := parseEnhance(`{"deinterlace":"bwdif","denoise":"hqdn3d","denoisestrength":4,"sharpen":0.6,"contrast":1.2}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf.EnhanceProfiles["analog"] = *profile
+	tests := []struct {
+		enhance string
+		want    string
+	}{
+		{``, "[0:v]bwdif=mode=0,hqdn3d=luma_spatial=4,eq=contrast=1.2,unsharp=luma_amount=0.6[out]"},
+		{`{"sharpen":0,"denoise":"none"}`, "[0:v]bwdif=mode=0,eq=contrast=1.2[out]"},
+		{`{"deinterlace":"none","contrast":0,"saturation":1.5}`, "[0:v]hqdn3d=luma_spatial=4,eq=saturation=1.5,unsharp=luma_amount=0.6[out]"},
+	}
+	for _, tt := range tests {
+		config := StreamConfig{EnhanceProfile: "analog"}
+		if tt.enhance != "" {
+			if config.Enhance, err = parseEnhance(tt.enhance); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := conf.resolveEnhance(&config); err != nil {
+			t.Fatal(err)
+		}
+		if err := validateEnhance(config.Enhance); err != nil {
+			t.Errorf("%s: %v", tt.enhance, err)
+		}
+		g := newFilterGraph("0:v")
+		enhanceFilter(g, &config)
+		g.Output("out")
+		if got := g.String(); got != tt.want {
+			t.Errorf("%s:\n got %s\nwant %s", tt.enhance, got, tt.want)
+		}
+	}
+	if profile := conf.EnhanceProfiles["analog"]; *profile.Sharpen != 0.6 || profile.Denoise != "hqdn3d" {
+		t.Errorf("profile modified: %+v", profile)
+	}
+}
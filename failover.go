@@ -0,0 +1,200 @@
+package transform
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// 备用源：源流中断超过 timeout 后切到下一路有画面的备用源，ffmpeg 原地重启，转码流地址不中断；
+// 更靠前的源恢复并持续 failback 时长后切回。配置了垫片或备用源时源流由 sourceInputs 订阅
+type FailoverConfig struct {
+	Backups  []string `yaml:"backups" json:"backups"`   //备用源流地址，按优先级排列，streampath 为主源
+	Timeout  int      `yaml:"timeout" json:"timeout"`   //多久没有画面视为中断，毫秒，默认 3000
+	Failback int      `yaml:"failback" json:"failback"` //靠前的源恢复后持续多久切回，毫秒，默认 10000
+}
+
+func defaultFailoverConfig(config *StreamConfig) {
+	failover := config.Failover
+	if failover == nil {
+		return
+	}
+	if failover.Timeout == 0 {
+		failover.Timeout = 3000
+	}
+	if failover.Failback == 0 {
+		failover.Failback = 10000
+	}
+}
+
+func validateFailover(config *StreamConfig) error {
+	failover := config.Failover
+	if failover == nil {
+		return nil
+	}
+	switch config.TransType {
+	case TransTypePipe, TransTypeLadder, TransTypePtz, TransTypePip:
+	default:
+		return fmt.Errorf("failover is not supported by transtype %d", config.TransType)
+	}
+	if len(failover.Backups) == 0 {
+		return errors.New("failover backups is empty")
+	}
+	seen := map[string]bool{config.StreamPath: true}
+	for _, path := range failover.Backups {
+		if path == "" || seen[path] {
+			return fmt.Errorf("invalid failover backup: %q", path)
+		}
+		seen[path] = true
+	}
+	if failover.Timeout < 500 || failover.Failback < 0 {
+		return fmt.Errorf("invalid failover timeout or failback: %d %d", failover.Timeout, failover.Failback)
+	}
+	return nil
+}
+
+// 由 sourceInputs 订阅的源流，按优先级排列
+func sourcePaths(config *StreamConfig) []string {
+	if config.Slate == nil && config.Failover == nil {
+		return nil
+	}
+	paths := []string{config.StreamPath}
+	if config.Failover != nil {
+		paths = append(paths, config.Failover.Backups...)
+	}
+	return paths
+}
+
+// 按配置创建缺少的源流订阅，停止不再需要的，正在使用的源流保持不变
+func (t *TransformTask) syncSourceInputs(config *StreamConfig) {
+	timeout := extraInputTimeout
+	if config.Failover != nil {
+		timeout = time.Duration(config.Failover.Timeout) * time.Millisecond
+	}
+	t.mt.Lock()
+	current := make(map[string]*extraInput)
+	for _, in := range t.sourceInputs {
+		current[in.streamPath] = in
+	}
+	activePath := ""
+	if len(t.sourceInputs) > 0 {
+		activePath = t.sourceInputs[t.activeSource].streamPath
+	}
+	var inputs, started []*extraInput
+	for _, path := range sourcePaths(config) {
+		in := current[path]
+		if in == nil {
+			in = &extraInput{task: t, streamPath: path, main: true, done: make(chan struct{})}
+			started = append(started, in)
+		}
+		delete(current, path)
+		in.mu.Lock()
+		in.timeout = timeout
+		in.mu.Unlock()
+		inputs = append(inputs, in)
+	}
+	t.sourceInputs = inputs
+	t.activeSource = 0
+	for i, in := range inputs {
+		if in.streamPath == activePath {
+			t.activeSource = i
+		}
+	}
+	t.mt.Unlock()
+	for _, in := range started {
+		go in.run()
+		go in.watch()
+	}
+	for _, in := range current {
+		TransformPlugin.Info("stop source input", zap.String("streamPath", in.streamPath))
+		in.stop()
+	}
+}
+
+// 源流由 sourceInputs 订阅
+func (t *TransformTask) sourceInputsActive() bool {
+	t.mt.Lock()
+	defer t.mt.Unlock()
+	return len(t.sourceInputs) > 0
+}
+
+// 正在使用的源流没有画面，调用前需持有 t.mt
+func (t *TransformTask) sourceDown() bool {
+	return len(t.sourceInputs) > 0 && !t.sourceInputs[t.activeSource].isLive()
+}
+
+// 选择要使用的源流，调用前需持有 t.mt
+// 正在使用的中断时取第一路有画面的，否则只在靠前的源恢复超过 failback 后切回
+func (t *TransformTask) selectSource(failback time.Duration) int {
+	active := t.activeSource
+	if !t.sourceInputs[active].isLive() {
+		for i, in := range t.sourceInputs {
+			if in.isLive() {
+				return i
+			}
+		}
+		return active
+	}
+	for i := 0; i < active; i++ {
+		in := t.sourceInputs[i]
+		in.mu.Lock()
+		healthy := in.live && time.Since(in.liveSince) >= failback
+		in.mu.Unlock()
+		if healthy {
+			return i
+		}
+	}
+	return active
+}
+
+// 源流有无画面变化或定时检查时调用，切换源流或进出垫片时原地重启 ffmpeg
+func (t *TransformTask) sourceChanged(reason string) {
+	before := t.effectiveConfig()
+	t.mt.Lock()
+	if len(t.sourceInputs) == 0 {
+		t.mt.Unlock()
+		return
+	}
+	var failback time.Duration
+	if t.streamConfig.Failover != nil {
+		failback = time.Duration(t.streamConfig.Failover.Failback) * time.Millisecond
+	}
+	from := t.sourceInputs[t.activeSource]
+	t.activeSource = t.selectSource(failback)
+	to := t.sourceInputs[t.activeSource]
+	if to != from {
+		to.mu.Lock()
+		if to.source.Width > 0 {
+			t.source = to.source
+		}
+		to.mu.Unlock()
+	}
+	t.mt.Unlock()
+
+	if to != from {
+		TransformPlugin.Info("switch source", zap.String("newStreamPath", before.NewStreamPath),
+			zap.String("from", from.streamPath), zap.String("to", to.streamPath))
+		t.restartFF("switch source to " + to.streamPath)
+		return
+	}
+	if !reflect.DeepEqual(before, t.effectiveConfig()) {
+		t.restartFF(reason)
+	}
+}
+
+// 源流的 SPS，正在使用的一路才更新任务的源尺寸
+func (in *extraInput) setSourceInfo(source SourceInfo) {
+	in.mu.Lock()
+	in.source = source
+	in.mu.Unlock()
+	t := in.task
+	t.mt.Lock()
+	active := len(t.sourceInputs) > 0 && t.sourceInputs[t.activeSource] == in
+	t.mt.Unlock()
+	if active {
+		t.setSource(source)
+	}
+}
@@ -0,0 +1,168 @@
+package transform
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// ffmpeg 进程转码
+type ffmpegTranscoder struct {
+	plugin *TransformConfig
+
+	cmd        *exec.Cmd
+	exited     chan struct{} //进程退出后关闭
+	stderrDone chan struct{} //标准错误读完后关闭
+	ins        []io.WriteCloser
+	outs       []io.ReadCloser
+
+	mt       sync.Mutex
+	progress TranscodeProgress
+
+	onOutputFail func(slave int, reason string) //tee 去掉了失败的一路外部地址
+}
+
+func (f *ffmpegTranscoder) Argv(config *StreamConfig) ([]string, error) {
+	return append([]string{f.plugin.Ffmpeg}, f.plugin.ffmpegCommand(config).Args...), nil
+}
+
+func (f *ffmpegTranscoder) Start(config *StreamConfig) (err error) {
+	command := f.plugin.ffmpegCommand(config)
+	cmd := exec.Command(f.plugin.Ffmpeg, command.Args...)
+	TransformPlugin.Info(cmd.String())
+
+	//获取输入流
+	f.ins = []io.WriteCloser{nil}
+	if command.PipeIn {
+		if f.ins[0], err = cmd.StdinPipe(); err != nil {
+			return
+		}
+	}
+	//获取输出流 句柄，第一路为标准输出，其余通过 ExtraFiles 从 fd 3 开始
+	//不用 StdoutPipe，Wait 会在读完之前关闭它，丢掉进程退出前写出的封装尾部
+	var childFiles []*os.File //交给子进程的管道端，启动后父进程关闭
+	defer func() {
+		for _, file := range childFiles {
+			file.Close()
+		}
+		if err != nil {
+			for _, r := range f.outs {
+				r.Close()
+			}
+			f.closeExtraInputs()
+		}
+	}()
+	for i := 0; i < command.PipeOuts; i++ {
+		r, w, err := os.Pipe()
+		if err != nil {
+			return err
+		}
+		childFiles = append(childFiles, w)
+		if i == 0 {
+			cmd.Stdout = w
+		} else {
+			cmd.ExtraFiles = append(cmd.ExtraFiles, w)
+		}
+		f.outs = append(f.outs, r)
+	}
+	//附加输入管道的读取端接在输出管道之后
+	for i := 0; i < command.ExtraIns; i++ {
+		r, w, err := os.Pipe()
+		if err != nil {
+			return err
+		}
+		childFiles = append(childFiles, r)
+		cmd.ExtraFiles = append(cmd.ExtraFiles, r)
+		f.ins = append(f.ins, w)
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return
+	}
+	if err = cmd.Start(); err != nil {
+		return
+	}
+	f.cmd = cmd
+	f.exited = make(chan struct{})
+	f.stderrDone = make(chan struct{})
+	go f.readProgress(stderr)
+	return
+}
+
+func (f *ffmpegTranscoder) Inputs() []io.WriteCloser {
+	return f.ins
+}
+
+func (f *ffmpegTranscoder) Outputs() []io.ReadCloser {
+	return f.outs
+}
+
+func (f *ffmpegTranscoder) Progress() TranscodeProgress {
+	f.mt.Lock()
+	defer f.mt.Unlock()
+	return f.progress
+}
+
+// Wait 会关闭标准错误，先等最后的进度和 tee 失败日志读完；输出管道由读取者读完后关闭
+func (f *ffmpegTranscoder) Wait() error {
+	<-f.stderrDone
+	err := f.cmd.Wait()
+	close(f.exited)
+	f.closeExtraInputs()
+	return err
+}
+
+// 标准输入由 Wait 关闭，附加输入在这里关闭
+func (f *ffmpegTranscoder) closeExtraInputs() {
+	if len(f.ins) > 1 {
+		for _, w := range f.ins[1:] {
+			w.Close()
+		}
+	}
+}
+
+// ffmpeg 收到 SIGTERM 后写完 flv mp4 等封装的尾部再退出，标准输入是数据管道，不能用 q 结束
+func (f *ffmpegTranscoder) Stop() error {
+	return stopProcess(f.cmd.Process, syscall.SIGTERM, f.exited)
+}
+
+// -progress pipe:2 输出 key=value，其余为 ffmpeg 日志
+func (f *ffmpegTranscoder) readProgress(stderr io.Reader) {
+	defer close(f.stderrDone)
+	scanner := bufio.NewScanner(stderr)
+	for scanner.Scan() {
+		line := scanner.Text()
+		key, value, ok := strings.Cut(line, "=")
+		if !ok || strings.ContainsAny(key, " \t") {
+			TransformPlugin.Debug("ffmpeg", zap.String("log", line))
+			if slave, reason, failed := parseTeeFailure(line); failed && f.onOutputFail != nil {
+				f.onOutputFail(slave, reason)
+			}
+			continue
+		}
+		f.mt.Lock()
+		switch key {
+		case "frame":
+			f.progress.Frame, _ = strconv.ParseInt(value, 10, 64)
+		case "fps":
+			f.progress.Fps = value
+		case "bitrate":
+			f.progress.Bitrate = value
+		case "out_time":
+			f.progress.OutTime = value
+		case "speed":
+			f.progress.Speed = value
+		case "progress":
+			f.progress.Time = time.Now()
+		}
+		f.mt.Unlock()
+	}
+}
@@ -0,0 +1,179 @@
+package transform
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"time"
+)
+
+// 以 mode 方式运行的假 ffmpeg，config 补全默认配置
+func fakeTranscoderFor(t *testing.T, mode string, config *StreamConfig) *ffmpegTranscoder {
+	conf := fakeFfmpegConfig(t, mode)
+	conf.SetDefaultStreamConfig(config)
+	return &ffmpegTranscoder{plugin: conf}
+}
+
+// 含换行、回车和 0 的二进制数据
+func binaryData(n int) []byte {
+	data := make([]byte, n)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	return data
+}
+
+// 输入管道的数据原样到输出管道，进度从标准错误解析
+func TestFfmpegTranscoderPipes(t *testing.T) {
+	config := StreamConfig{StreamPath: "live/a"}
+	f := fakeTranscoderFor(t, "copy", &config)
+	if err := f.Start(&config); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		f.Stop()
+		f.Wait()
+		f.Outputs()[0].Close()
+	}()
+	if len(f.Inputs()) != 1 || f.Inputs()[0] == nil || len(f.Outputs()) != 1 {
+		t.Fatal("pipes not opened")
+	}
+	data := binaryData(188 * 100)
+	go f.Inputs()[0].Write(data)
+	got := make([]byte, len(data))
+	if _, err := io.ReadFull(f.Outputs()[0], got); err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("echo mismatch: %v", err)
+	}
+	waitFor(t, "progress", func() bool { return f.Progress().Frame == 1 })
+	if p := f.Progress(); p.Fps != "25.0" || p.Speed != "1x" || p.OutTime != "00:00:00.040000" || p.Time.IsZero() {
+		t.Errorf("progress = %+v", p)
+	}
+}
+
+// 崩溃时已输出的数据照常读到，Wait 返回错误
+func TestFfmpegTranscoderCrash(t *testing.T) {
+	config := StreamConfig{StreamPath: "live/a"}
+	f := fakeTranscoderFor(t, "crash", &config)
+	if err := f.Start(&config); err != nil {
+		t.Fatal(err)
+	}
+	data := binaryData(188)
+	if _, err := f.Inputs()[0].Write(data); err != nil {
+		t.Fatal(err)
+	}
+	got, _ := io.ReadAll(f.Outputs()[0])
+	if !bytes.Equal(got, data) {
+		t.Errorf("read %d bytes before crash, want %d", len(got), len(data))
+	}
+	if err := f.Wait(); err == nil {
+		t.Error("crash not reported")
+	}
+}
+
+// 卡死时没有输出，Stop 后 Wait 返回
+func TestFfmpegTranscoderStall(t *testing.T) {
+	config := StreamConfig{StreamPath: "live/a"}
+	f := fakeTranscoderFor(t, "stall", &config)
+	if err := f.Start(&config); err != nil {
+		t.Fatal(err)
+	}
+	read := make(chan int, 1)
+	go func() {
+		n, _ := io.Copy(io.Discard, f.Outputs()[0])
+		read <- int(n)
+	}()
+	waitFor(t, "progress", func() bool { return f.Progress().Frame == 1 })
+	select {
+	case n := <-read:
+		t.Fatalf("output closed after %d bytes", n)
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- f.Wait() }()
+	f.Stop()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("wait did not return after stop")
+	}
+	if n := <-read; n != 0 {
+		t.Errorf("stalled ffmpeg wrote %d bytes", n)
+	}
+}
+
+// Stop 先发 SIGTERM，ffmpeg 写完收尾数据后正常退出，不等到超时强制结束
+func TestFfmpegTranscoderStop(t *testing.T) {
+	config := StreamConfig{StreamPath: "live/a"}
+	f := fakeTranscoderFor(t, "copy", &config)
+	if err := f.Start(&config); err != nil {
+		t.Fatal(err)
+	}
+	data := binaryData(188 * 10)
+	if _, err := f.Inputs()[0].Write(data); err != nil {
+		t.Fatal(err)
+	}
+	got := make([]byte, len(data))
+	if _, err := io.ReadFull(f.Outputs()[0], got); err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("echo mismatch: %v", err)
+	}
+
+	start := time.Now()
+	if err := f.Stop(); err != nil {
+		t.Fatal(err)
+	}
+	trailer, _ := io.ReadAll(f.Outputs()[0])
+	if !bytes.Equal(trailer, tsNullPacket) {
+		t.Errorf("trailer after SIGTERM = % x", trailer)
+	}
+	if err := f.Wait(); err != nil {
+		t.Errorf("wait: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed >= transcoderStopTimeout {
+		t.Errorf("stop took %v, killed instead of exiting", elapsed)
+	}
+}
+
+// 进程退出前写出的最后几行日志在 Wait 返回前已处理
+func TestFfmpegTranscoderWaitReadsStderr(t *testing.T) {
+	config := pullConfig("test/exit")
+	f := fakeTranscoderFor(t, "exit", &config)
+	failed := 0
+	f.onOutputFail = func(int, string) { failed++ }
+	if err := f.Start(&config); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Wait(); err == nil {
+		t.Error("exit status not reported")
+	}
+	if p := f.Progress(); p.Frame != 1 || failed != 1 {
+		t.Errorf("after wait: frame %d, %d tee failures", p.Frame, failed)
+	}
+}
+
+// tee 去掉失败的一路时回调
+func TestFfmpegTranscoderOutputFail(t *testing.T) {
+	config := pullConfig("test/tee")
+	f := fakeTranscoderFor(t, "copy", &config)
+	type failure struct {
+		slave  int
+		reason string
+	}
+	failed := make(chan failure, 1)
+	f.onOutputFail = func(slave int, reason string) { failed <- failure{slave, reason} }
+	if err := f.Start(&config); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		f.Stop()
+		f.Wait()
+	}()
+	select {
+	case got := <-failed:
+		if got.slave != 1 || got.reason != "Connection refused" {
+			t.Errorf("onOutputFail(%d, %q)", got.slave, got.reason)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("onOutputFail not called")
+	}
+}
@@ -0,0 +1,136 @@
+package transform
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// 循环播放本地文件：ffmpeg 以 -stream_loop -1 -re 按实时速度反复读取 path 下的文件，
+// 转码、叠加后同样以 ts 流发布到 newstreampath，用于演示和测试。seek 修改起始位置后原地重启 ffmpeg
+type FileConfig struct {
+	Path   string  `yaml:"path" json:"path"`     //文件路径，相对于 TransformConfig.Path，不能超出该目录
+	Offset float64 `yaml:"offset" json:"offset"` //从第几秒开始播放，播完一遍后从头循环
+}
+
+func validateFile(config *StreamConfig) error {
+	if config.TransType != TransTypeFile {
+		if config.File != nil {
+			return errors.New("file requires transtype 8")
+		}
+		return nil
+	}
+	file := config.File
+	if file == nil || file.Path == "" {
+		return errors.New("file path is empty")
+	}
+	path := filepath.Clean(file.Path)
+	if filepath.IsAbs(path) || path == ".." || strings.HasPrefix(path, ".."+string(filepath.Separator)) {
+		return fmt.Errorf("file path must be relative to path: %s", file.Path)
+	}
+	if file.Offset < 0 {
+		return fmt.Errorf("invalid file offset: %v", file.Offset)
+	}
+	return nil
+}
+
+// 任务启动前检查文件存在
+func (t *TransformConfig) checkFile(config *StreamConfig) error {
+	if config.File == nil {
+		return nil
+	}
+	path := t.logoPath(config.File.Path)
+	if info, err := os.Stat(path); err != nil {
+		return fmt.Errorf("file %s: %w", path, err)
+	} else if info.IsDir() {
+		return fmt.Errorf("file %s is a directory", path)
+	}
+	return t.checkUnderPath(path)
+}
+
+// 解析符号链接后仍需在 Path 目录下，目录中的链接不能指向其他文件
+func (t *TransformConfig) checkUnderPath(path string) error {
+	root := t.Path
+	if root == "" {
+		root = "."
+	}
+	real, err := filepath.EvalSymlinks(path)
+	if err == nil {
+		real, err = filepath.Abs(real)
+	}
+	if err != nil {
+		return fmt.Errorf("file %s: %w", path, err)
+	}
+	realRoot, err := filepath.EvalSymlinks(root)
+	if err == nil {
+		realRoot, err = filepath.Abs(realRoot)
+	}
+	if err != nil {
+		return fmt.Errorf("path %s: %w", root, err)
+	}
+	rel, err := filepath.Rel(realRoot, real)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return fmt.Errorf("file %s resolves outside path", path)
+	}
+	return nil
+}
+
+// 无限循环、按实时速度读取，-ss 放在 -i 前按关键帧快速定位
+func (t *TransformConfig) fileInputArgs(config *StreamConfig) []string {
+	args := []string{"-stream_loop", "-1", "-re"}
+	if config.File.Offset > 0 {
+		args = append(args, "-ss", strconv.FormatFloat(config.File.Offset, 'f', -1, 64))
+	}
+	return append(args, "-i", t.logoPath(config.File.Path))
+}
+
+// 定位结果
+type SeekResult struct {
+	NewStreamPath string  `json:"newStreamPath"`
+	Path          string  `json:"path"`
+	Offset        float64 `json:"offset"`
+}
+
+// /transform/seek?newstreampath=xxx&offset=90 从第 90 秒开始播放
+// 省略 offset 时返回当前配置
+func (t *TransformConfig) Seek(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	task, newStreamPath := lookupTask(w, r)
+	if task == nil {
+		return
+	}
+	config := task.callerConfig(newStreamPath)
+	if config.File == nil {
+		http.Error(w, "task is not file", http.StatusBadRequest)
+		return
+	}
+
+	if query.Has("offset") {
+		//共用的任务定位会影响其他调用者
+		if !taskOwned(w, task) {
+			return
+		}
+		file := *config.File
+		offset, err := strconv.ParseFloat(query.Get("offset"), 64)
+		if err != nil {
+			err = fmt.Errorf("invalid offset: %s", query.Get("offset"))
+		} else {
+			file.Offset = offset
+			config.File = &file
+			err = t.resolveStreamConfig(&config)
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		task.update(config)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(SeekResult{NewStreamPath: newStreamPath, Path: config.File.Path, Offset: config.File.Offset})
+}
@@ -0,0 +1,173 @@
+package transform
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// 拼装 ffmpeg -filter_complex 滤镜图
+// 主链上的滤镜依次追加，需要多路输入输出时先用 Pad 闭合主链，再用 Chain 连接
+type filterGraph struct {
+	chains  []string //已闭合的滤镜链
+	current []string //主链上尚未闭合的滤镜
+	in      string   //主链输入 pad
+	seq     int
+	names   []string //用到的滤镜名，用于能力校验
+}
+
+func newFilterGraph(in string) *filterGraph {
+	return &filterGraph{in: in}
+}
+
+// 格式化一个滤镜，args 为已转义的 key=value
+func (g *filterGraph) F(name string, args ...string) string {
+	g.use(name)
+	if len(args) == 0 {
+		return name
+	}
+	return name + "=" + strings.Join(args, ":")
+}
+
+// 在主链上追加一个滤镜
+func (g *filterGraph) Filter(name string, args ...string) *filterGraph {
+	g.current = append(g.current, g.F(name, args...))
+	return g
+}
+
+// 在主链上追加由 F 生成的滤镜
+func (g *filterGraph) Append(filters ...string) *filterGraph {
+	g.current = append(g.current, filters...)
+	return g
+}
+
+// 添加一条独立的滤镜链，filters 由 F 生成
+func (g *filterGraph) Chain(ins []string, outs []string, filters ...string) {
+	if len(filters) == 0 {
+		filters = []string{"null"}
+	}
+	g.chains = append(g.chains, pads(ins...)+strings.Join(filters, ",")+pads(outs...))
+}
+
+// 闭合主链，返回其输出 pad，主链从该 pad 继续
+func (g *filterGraph) Pad() string {
+	if len(g.current) == 0 {
+		return g.in
+	}
+	out := g.Label("v")
+	g.Output(out)
+	g.in = out
+	return out
+}
+
+// 主链改从 pad 继续
+func (g *filterGraph) Continue(pad string) {
+	g.Pad()
+	g.in = pad
+}
+
+// 闭合主链并复制为 n 路，返回各路 pad
+func (g *filterGraph) Split(n int) []string {
+	outs := make([]string, n)
+	for i := range outs {
+		outs[i] = g.Label("s")
+	}
+	g.current = append(g.current, g.F("split", fmt.Sprint(n)))
+	g.chains = append(g.chains, pads(g.in)+strings.Join(g.current, ",")+pads(outs...))
+	g.current = nil
+	g.in = ""
+	return outs
+}
+
+// 闭合主链，输出到 out pad
+func (g *filterGraph) Output(out string) {
+	current := g.current
+	if len(current) == 0 {
+		current = []string{"null"}
+	}
+	g.chains = append(g.chains, pads(g.in)+strings.Join(current, ",")+pads(out))
+	g.current = nil
+}
+
+// 生成一个不重复的 pad 名
+func (g *filterGraph) Label(prefix string) string {
+	g.seq++
+	return fmt.Sprintf("%s%d", prefix, g.seq)
+}
+
+func (g *filterGraph) use(name string) {
+	//去掉实例名 crop@ptz
+	name, _, _ = strings.Cut(name, "@")
+	for _, n := range g.names {
+		if n == name {
+			return
+		}
+	}
+	g.names = append(g.names, name)
+}
+
+// 用到的滤镜名
+func (g *filterGraph) Names() []string {
+	return g.names
+}
+
+func (g *filterGraph) String() string {
+	return strings.Join(g.chains, ";")
+}
+
+func pads(labels ...string) string {
+	var b strings.Builder
+	for _, label := range labels {
+		b.WriteString("[" + label + "]")
+	}
+	return b.String()
+}
+
+// ffmpeg 转义，在反斜杠和 special 中的字符前加反斜杠
+func ffEscape(s string, special string) string {
+	var b strings.Builder
+	for _, c := range s {
+		if c == '\\' || strings.ContainsRune(special, c) {
+			b.WriteByte('\\')
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
+
+// 滤镜选项值先后经过滤镜图解析和选项解析，需要两级转义
+func filterValue(s string) string {
+	return ffEscape(ffEscape(s, `':`), `'[],;`)
+}
+
+// text 为已按 drawtext 规则转义的文字
+func drawtextText(text string) string {
+	return "text=" + filterValue(text)
+}
+
+// 从文件读取文字，每帧重新读取，文件内容按 drawtext 规则转义
+func drawtextFile(path string) string {
+	return "textfile=" + filterValue(path) + ":reload=1"
+}
+
+// 单行文字叠加参数，boxcolor 为空时不加背景框
+func drawtextArgs(fontfile string, fontsize int, text string, x, y int, fontcolor, boxcolor string) []string {
+	//drawtext 自身会展开 %{} 和反斜杠
+	return drawtextRawArgs(fontfile, fontsize, drawtextText(ffEscape(text, "%")), strconv.Itoa(x), strconv.Itoa(y), fontcolor, boxcolor)
+}
+
+// source 为 drawtextText 或 drawtextFile 生成的文字来源，x y 为表达式
+func drawtextRawArgs(fontfile string, fontsize int, source string, x, y string, fontcolor, boxcolor string) []string {
+	args := []string{
+		fmt.Sprintf("fontsize=%d", fontsize),
+		"fontfile=" + filterValue(fontfile),
+		source,
+		"x=" + filterValue(x),
+		"y=" + filterValue(y),
+		"fontcolor=" + filterValue(fontcolor),
+	}
+	if boxcolor != "" {
+		args = append(args, "box=1", "boxcolor="+filterValue(boxcolor))
+	}
+	return args
+}
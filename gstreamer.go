@@ -0,0 +1,216 @@
+package transform
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// gst-launch 进程转码，只支持订阅裸流转码后发布 ts 流
+// 分辨率、帧率、码率、编码器和单行 osd 之外的配置不支持
+type gstTranscoder struct {
+	plugin *TransformConfig
+
+	cmd     *exec.Cmd
+	exited  chan struct{} //进程退出后关闭
+	in      io.WriteCloser
+	out     io.ReadCloser
+	started time.Time
+}
+
+// videocodec 对应的 gstreamer 编码器
+var gstEncoders = map[string]string{
+	"libx264": "x264enc tune=zerolatency",
+	"libx265": "x265enc tune=zerolatency",
+}
+
+// osdfontcolor 对应的 ARGB
+var gstColors = map[string]string{
+	"white":  "0xffffffff",
+	"black":  "0xff000000",
+	"red":    "0xffff0000",
+	"green":  "0xff00ff00",
+	"blue":   "0xff0000ff",
+	"yellow": "0xffffff00",
+}
+
+func (g *gstTranscoder) Argv(config *StreamConfig) ([]string, error) {
+	if err := gstSupported(config); err != nil {
+		return nil, err
+	}
+	encoder, ok := gstEncoders[config.VideoCodec]
+	if !ok {
+		return nil, fmt.Errorf("video encoder %s not supported by gstreamer backend", config.VideoCodec)
+	}
+	res, err := parseResolution(config.Resolution)
+	if err != nil {
+		return nil, err
+	}
+	fps, err := strconv.ParseFloat(config.Fps, 64)
+	if err != nil {
+		return nil, err
+	}
+
+	//gst-launch 会把参数以空格拼接后再解析
+	argv := []string{g.plugin.Gstreamer, "-q", "-e",
+		"fdsrc", "fd=0", "!", "h264parse", "!", "avdec_h264", "!",
+		"videoconvert", "!", "videoscale", "!",
+	}
+	//max: -2*480 等按源宽高比推导的尺寸由 gstResolution 换算，收到 SPS 前保持源尺寸
+	if res.boxed() && !res.Max {
+		argv = append(argv, fmt.Sprintf("video/x-raw,width=%d,height=%d", res.W, res.H), "!")
+	}
+	argv = append(argv,
+		"videorate", "!",
+		fmt.Sprintf("video/x-raw,framerate=%d/100", int(fps*100)), "!",
+	)
+	if config.OsdText != "" {
+		argv = append(argv, "textoverlay",
+			"text="+gstQuote(config.OsdText),
+			fmt.Sprintf("font-desc=%s", gstQuote(fmt.Sprintf("Sans %dpx", config.OsdFontsize))),
+			"halignment=left", "valignment=top",
+			fmt.Sprintf("deltax=%d", config.OsdX), fmt.Sprintf("deltay=%d", config.OsdY),
+		)
+		if color, ok := gstColors[config.OsdFontColor]; ok {
+			argv = append(argv, "color="+color)
+		}
+		if config.OsdBox != 0 {
+			argv = append(argv, "shaded-background=true")
+		}
+		argv = append(argv, "!")
+	}
+	argv = append(argv, strings.Fields(encoder)...)
+	if config.Bitrate != "" {
+		//x264enc x265enc 的码率单位为 kbit/s
+		kbps, err := bitrateKbps(config.Bitrate)
+		if err != nil {
+			return nil, err
+		}
+		argv = append(argv, fmt.Sprintf("bitrate=%d", kbps))
+	}
+	argv = append(argv, "!", "mpegtsmux", "!", "fdsink", "fd=1")
+	return argv, nil
+}
+
+// gstreamer 只支持基本配置，其余字段有值时拒绝
+func gstSupported(config *StreamConfig) error {
+	if config.TransType != TransTypePipe {
+		return errors.New("gstreamer backend only supports transtype 0")
+	}
+	basic := StreamConfig{
+		TransType:     config.TransType,
+		StreamPath:    config.StreamPath,
+		NewStreamPath: config.NewStreamPath,
+		Resolution:    config.Resolution,
+		VideoCodec:    config.VideoCodec,
+		Fps:           config.Fps,
+		Bitrate:       config.Bitrate,
+		HasOsd:        config.HasOsd,
+		OsdText:       config.OsdText,
+		OsdFontsize:   config.OsdFontsize,
+		OsdFontColor:  config.OsdFontColor,
+		OsdX:          config.OsdX,
+		OsdY:          config.OsdY,
+		OsdBox:        config.OsdBox,
+		OsdBoxcolor:   config.OsdBoxcolor,
+		textID:        config.textID,
+	}
+	if !reflect.DeepEqual(&basic, config) {
+		return errors.New("config not supported by gstreamer backend")
+	}
+	return nil
+}
+
+// gstreamer 管道不能按源宽高比缩放到框内，收到 SPS 后把 max: -2*480 等换算成固定尺寸
+func gstResolution(s string, source SourceInfo) string {
+	res, err := parseResolution(s)
+	if err != nil || res.Keep || (res.boxed() && !res.Max) || source.Width == 0 || source.Height == 0 {
+		return s
+	}
+	w, h := res.size(source)
+	return fmt.Sprintf("%d*%d", w, h)
+}
+
+func gstQuote(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
+
+// 400k 2M 转成 kbit/s
+func bitrateKbps(bitrate string) (int, error) {
+	unit := 1
+	switch bitrate[len(bitrate)-1] {
+	case 'k', 'K':
+		bitrate = bitrate[:len(bitrate)-1]
+	case 'm', 'M':
+		bitrate, unit = bitrate[:len(bitrate)-1], 1000
+	default:
+		unit = 0
+	}
+	n, err := strconv.Atoi(bitrate)
+	if err != nil {
+		return 0, err
+	}
+	if unit == 0 {
+		return n / 1000, nil
+	}
+	return n * unit, nil
+}
+
+func (g *gstTranscoder) Start(config *StreamConfig) (err error) {
+	argv, err := g.Argv(config)
+	if err != nil {
+		return
+	}
+	cmd := exec.Command(argv[0], argv[1:]...)
+	TransformPlugin.Info(cmd.String())
+	if g.in, err = cmd.StdinPipe(); err != nil {
+		return
+	}
+	//与 ffmpeg 相同，不用 StdoutPipe，EOS 后输出的缓存要等读取者读完
+	out, w, err := os.Pipe()
+	if err != nil {
+		return
+	}
+	cmd.Stdout = w
+	err = cmd.Start()
+	w.Close()
+	if err != nil {
+		out.Close()
+		return
+	}
+	g.out = out
+	g.cmd = cmd
+	g.exited = make(chan struct{})
+	g.started = time.Now()
+	return
+}
+
+func (g *gstTranscoder) Inputs() []io.WriteCloser {
+	return []io.WriteCloser{g.in}
+}
+
+func (g *gstTranscoder) Outputs() []io.ReadCloser {
+	return []io.ReadCloser{g.out}
+}
+
+// gst-launch 没有进度输出，只返回启动时间
+func (g *gstTranscoder) Progress() TranscodeProgress {
+	return TranscodeProgress{Time: g.started}
+}
+
+func (g *gstTranscoder) Wait() error {
+	err := g.cmd.Wait()
+	close(g.exited)
+	return err
+}
+
+// gst-launch -e 收到 SIGINT 后发送 EOS，mpegtsmux 输出完缓存再退出
+func (g *gstTranscoder) Stop() error {
+	return stopProcess(g.cmd.Process, os.Interrupt, g.exited)
+}
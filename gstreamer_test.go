@@ -0,0 +1,54 @@
+package transform
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestGstResolution(t *testing.T) {
+	source := SourceInfo{Width: 1920, Height: 1080}
+	tests := []struct {
+		res    string
+		source SourceInfo
+		want   string
+	}{
+		{"max:352*288", source, "352*198"},
+		{"max:352*288", SourceInfo{}, "max:352*288"}, //收到 SPS 前不换算
+		{"max:3840*2160", source, "1920*1080"},       //不放大
+		{"-2*480", source, "854*480"},
+		{"640*-1", source, "640*360"},
+		{"720*576", source, "720*576"},
+		{"keep", source, "keep"},
+	}
+	for _, test := range tests {
+		if got := gstResolution(test.res, test.source); got != test.want {
+			t.Errorf("gstResolution(%q, %v) = %q, want %q", test.res, test.source, got, test.want)
+		}
+	}
+}
+
+func TestGstArgvSize(t *testing.T) {
+	g := &gstTranscoder{plugin: &TransformConfig{Gstreamer: "gst-launch-1.0"}}
+	config := StreamConfig{StreamPath: "live/a", NewStreamPath: "live/a-ts0", VideoCodec: "libx264", Fps: "25", textID: "1"}
+	tests := []struct {
+		res  string
+		caps string
+	}{
+		{"max:352*288", ""},
+		{"352*198", "video/x-raw,width=352,height=198"},
+	}
+	for _, test := range tests {
+		config.Resolution = test.res
+		argv, err := g.Argv(&config)
+		if err != nil {
+			t.Fatalf("%s: %v", test.res, err)
+		}
+		line := strings.Join(argv, " ")
+		if test.caps == "" && strings.Contains(line, "width=") {
+			t.Errorf("%s: unexpected size caps in %s", test.res, line)
+		}
+		if test.caps != "" && !strings.Contains(line, test.caps) {
+			t.Errorf("%s: missing %s in %s", test.res, test.caps, line)
+		}
+	}
+}
@@ -0,0 +1,378 @@
+package transform
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// 主输入之外的订阅输入，如画中画的小画面、画面拼接的各格，每个源流一个订阅者，从附加管道送给 ffmpeg
+// 源中断时 ffmpeg 原地重启去掉这一路，由占位画面代替，源恢复后再原地重启加回来
+// 配置了垫片或备用源时源流也用它订阅，见 failover.go
+type extraInput struct {
+	task       *TransformTask
+	streamPath string
+	main       bool          //任务的源流（含备用源），配置了垫片或备用源时使用，当前使用的一路写入主输入管道
+	timeout    time.Duration //多久没有画面视为中断
+	done       chan struct{} //不再需要这一路时关闭
+
+	mu        sync.Mutex
+	s         *TransformSubscriber
+	wp        io.WriteCloser //ffmpeg 的附加输入管道，这一路不在命令中时为 nil
+	paramSets [][]byte       //缓存的 SPS PPS，ffmpeg 重启后补发
+	live      bool           //正在收到画面
+	liveSince time.Time      //最近一次恢复画面的时间
+	lastFrame time.Time
+	source    SourceInfo //从 SPS 解析的源尺寸，仅源流
+}
+
+// 源多久没有画面视为中断
+const extraInputTimeout = 3 * time.Second
+
+// 附加输入的源流地址，去掉重复，顺序与 ffmpeg 的输入序号对应
+func extraSources(config *StreamConfig) []string {
+	var sources []string
+	switch config.TransType {
+	case TransTypePip:
+		if config.Pip != nil {
+			sources = append(sources, config.Pip.StreamPath)
+		}
+	case TransTypeMosaic:
+		if config.Mosaic != nil {
+			for _, tile := range config.Mosaic.Tiles {
+				if tile.StreamPath != "" {
+					sources = append(sources, tile.StreamPath)
+				}
+			}
+		}
+	}
+	seen := make(map[string]bool)
+	unique := sources[:0]
+	for _, path := range sources {
+		if !seen[path] {
+			seen[path] = true
+			unique = append(unique, path)
+		}
+	}
+	return unique
+}
+
+// 有画面的附加输入，依次接在主输入之后
+func liveSources(config *StreamConfig) []string {
+	var live []string
+	for _, path := range extraSources(config) {
+		if config.inputLive[path] {
+			live = append(live, path)
+		}
+	}
+	return live
+}
+
+// 画面拼接没有主输入，附加输入从 0 开始编号
+func hasMainInput(config *StreamConfig) bool {
+	return config.TransType != TransTypeMosaic
+}
+
+// 附加输入的 ffmpeg 参数，只包含有画面的源，管道 fd 接在输出管道之后（第一路输出为标准输出，不占 fd）
+func extraInputArgs(config *StreamConfig, pipeOuts int) (args []string, n int) {
+	live := liveSources(config)
+	base := 3
+	if pipeOuts > 1 {
+		base += pipeOuts - 1
+	}
+	for i := range live {
+		args = append(args, "-re", "-i", fmt.Sprintf("pipe:%d", base+i))
+	}
+	return args, len(live)
+}
+
+// 源流在 ffmpeg 中的输入序号，没有画面时返回 false
+func extraInputIndex(config *StreamConfig, streamPath string) (int, bool) {
+	base := 0
+	if hasMainInput(config) {
+		base = 1
+	}
+	for i, path := range liveSources(config) {
+		if path == streamPath {
+			return base + i, true
+		}
+	}
+	return 0, false
+}
+
+// 附加输入等比缩放到 w*h，不足的部分居中补边，时间戳从 0 开始
+func fitFilters(g *filterGraph, w, h int) []string {
+	return []string{
+		g.F("setpts", "PTS-STARTPTS"),
+		g.F("scale", fmt.Sprintf("w=%d", w), fmt.Sprintf("h=%d", h), "force_original_aspect_ratio=decrease"),
+		g.F("pad", fmt.Sprintf("w=%d", w), fmt.Sprintf("h=%d", h), "x=(ow-iw)/2", "y=(oh-ih)/2"),
+		g.F("setsar", "1"),
+	}
+}
+
+// 附加输入没有画面时代替它的 w*h 占位画面，中间显示 text
+func (t *TransformConfig) placeholderFilters(g *filterGraph, config *StreamConfig, text string, w, h int) []string {
+	return []string{
+		g.F("color", "c=0x202020", fmt.Sprintf("s=%dx%d", w, h), "r="+config.Fps),
+		g.F("drawtext", drawtextRawArgs(t.Fontfile, h/8, drawtextText(ffEscape(text, "%")),
+			"(w-text_w)/2", "(h-text_h)/2", "white", "")...),
+	}
+}
+
+// 按配置创建缺少的附加输入并开始订阅，停止不再需要的，任务启动和修改配置时调用
+func (t *TransformTask) syncExtraInputs() {
+	config := t.config()
+	t.mt.Lock()
+	current := make(map[string]*extraInput)
+	for _, in := range t.extraInputs {
+		current[in.streamPath] = in
+	}
+	var inputs, started []*extraInput
+	for _, path := range extraSources(&config) {
+		in := current[path]
+		if in == nil {
+			in = &extraInput{task: t, streamPath: path, timeout: extraInputTimeout, done: make(chan struct{})}
+			started = append(started, in)
+		}
+		delete(current, path)
+		inputs = append(inputs, in)
+	}
+	t.extraInputs = inputs
+	t.mt.Unlock()
+	for _, in := range started {
+		go in.run()
+		go in.watch()
+	}
+	for _, in := range current {
+		TransformPlugin.Info("stop extra input", zap.String("streamPath", in.streamPath))
+		in.stop()
+	}
+	t.syncSourceInputs(&config)
+}
+
+// 各源流是否有画面，调用前需持有 t.mt
+func (t *TransformTask) inputsLive() map[string]bool {
+	if len(t.extraInputs) == 0 {
+		return nil
+	}
+	live := make(map[string]bool)
+	for _, in := range t.extraInputs {
+		in.mu.Lock()
+		live[in.streamPath] = in.live
+		in.mu.Unlock()
+	}
+	return live
+}
+
+// 附加输入状态
+type InputStatus struct {
+	StreamPath string    `json:"streamPath"`
+	Live       bool      `json:"live"` //正在收到画面，否则显示占位画面
+	LastFrame  time.Time `json:"lastFrame"`
+}
+
+// 调用前需持有 t.mt
+func (t *TransformTask) inputStatus() []InputStatus {
+	var status []InputStatus
+	inputs := append(append([]*extraInput(nil), t.sourceInputs...), t.extraInputs...)
+	for _, in := range inputs {
+		in.mu.Lock()
+		status = append(status, InputStatus{StreamPath: in.streamPath, Live: in.live, LastFrame: in.lastFrame})
+		in.mu.Unlock()
+	}
+	return status
+}
+
+// ffmpeg 启动后把附加输入管道交给对应的输入，writers 第一路为主输入，ffmpeg 退出后以 nil 调用
+func (t *TransformTask) setExtraWriters(config *StreamConfig, writers []io.WriteCloser) {
+	index := make(map[string]int)
+	for i, path := range liveSources(config) {
+		index[path] = i + 1
+	}
+	t.mt.Lock()
+	inputs := t.extraInputs
+	sources := t.sourceInputs
+	active := t.activeSource
+	t.mt.Unlock()
+	//只有正在使用的源流写入主输入管道
+	for i, in := range sources {
+		var wp io.WriteCloser
+		if i == active && !config.slateActive && len(writers) > 0 {
+			wp = writers[0]
+		}
+		in.setWriter(wp)
+	}
+	for _, in := range inputs {
+		var wp io.WriteCloser
+		if i, ok := index[in.streamPath]; ok && i < len(writers) {
+			wp = writers[i]
+		}
+		in.setWriter(wp)
+	}
+}
+
+func (t *TransformTask) stopExtraInputs() {
+	t.mt.Lock()
+	inputs := append(t.extraInputs, t.sourceInputs...)
+	t.extraInputs = nil
+	t.sourceInputs = nil
+	t.mt.Unlock()
+	for _, in := range inputs {
+		in.stop()
+	}
+}
+
+func (in *extraInput) stop() {
+	in.mu.Lock()
+	s := in.s
+	select {
+	case <-in.done:
+	default:
+		close(in.done)
+	}
+	in.mu.Unlock()
+	if s != nil {
+		taskEngine.Unsubscribe(s, "extra input stopped")
+	}
+}
+
+func (in *extraInput) isLive() bool {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	return in.live
+}
+
+func (in *extraInput) stopped() bool {
+	select {
+	case <-in.done:
+		return true
+	default:
+		return in.task.exiting()
+	}
+}
+
+// 订阅源流，流结束后等待重新发布再订阅，任务结束或不再需要时退出
+func (in *extraInput) run() {
+	for !in.stopped() {
+		s := &TransformSubscriber{task: in.task, input: in}
+		in.mu.Lock()
+		in.s = s
+		in.mu.Unlock()
+		if err := taskEngine.Subscribe(in.streamPath, s); err != nil {
+			TransformPlugin.Warn("extra input subscribe", zap.String("streamPath", in.streamPath), zap.Error(err))
+		} else if in.stopped() {
+			//订阅期间已被停止，stop 时还没有这个订阅者
+			taskEngine.Unsubscribe(s, "extra input stopped")
+		} else {
+			taskEngine.Play(s)
+		}
+		in.setLive(false)
+		select {
+		case <-in.done:
+			return
+		case <-in.task.done:
+			return
+		case <-time.After(extraInputTimeout):
+		}
+	}
+}
+
+// 长时间没有画面视为中断
+func (in *extraInput) watch() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-in.done:
+			return
+		case <-in.task.done:
+			return
+		case <-ticker.C:
+			in.mu.Lock()
+			stale := in.live && time.Since(in.lastFrame) > in.timeout
+			in.mu.Unlock()
+			if stale {
+				in.setLive(false)
+			} else if in.main {
+				//备用源在用时检查主源是否已恢复足够久
+				in.task.sourceChanged("failback")
+			}
+		}
+	}
+}
+
+// 有无画面变化时原地重启 ffmpeg，加入或去掉这一路
+func (in *extraInput) setLive(live bool) {
+	in.mu.Lock()
+	if in.live == live {
+		in.mu.Unlock()
+		return
+	}
+	in.live = live
+	in.lastFrame = time.Now()
+	if live {
+		in.liveSince = in.lastFrame
+	}
+	in.mu.Unlock()
+	if in.stopped() {
+		return
+	}
+	switch {
+	case in.main && live:
+		in.task.sourceChanged("source live: " + in.streamPath)
+	case in.main:
+		in.task.sourceChanged("source lost: " + in.streamPath)
+	case live:
+		in.task.restartFF("extra input live: " + in.streamPath)
+	default:
+		in.task.restartFF("extra input lost: " + in.streamPath)
+	}
+}
+
+func (in *extraInput) setParamSets(paramSets [][]byte) {
+	in.mu.Lock()
+	in.paramSets = paramSets
+	wp := in.wp
+	in.mu.Unlock()
+	if wp != nil {
+		for _, buf := range paramSets {
+			wp.Write(buf)
+		}
+	}
+}
+
+func (in *extraInput) setWriter(wp io.WriteCloser) {
+	in.mu.Lock()
+	in.wp = wp
+	paramSets := in.paramSets
+	in.mu.Unlock()
+	if wp != nil {
+		for _, buf := range paramSets {
+			wp.Write(buf)
+		}
+	}
+}
+
+// 收到 SPS PPS 后的第一帧视为源恢复
+func (in *extraInput) write(buf []byte) {
+	in.mu.Lock()
+	in.lastFrame = time.Now()
+	wp := in.wp
+	becomeLive := !in.live && len(in.paramSets) > 0
+	in.mu.Unlock()
+	if becomeLive {
+		in.setLive(true)
+	}
+	if wp != nil {
+		if in.main {
+			in.task.mt.Lock()
+			in.task.status = 1
+			in.task.in_bytes += len(buf)
+			in.task.mt.Unlock()
+		}
+		wp.Write(buf)
+	}
+}
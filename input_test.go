@@ -0,0 +1,103 @@
+package transform
+
+import (
+	"strings"
+	"testing"
+)
+
+// 第一路输出为标准输出，其余输出占 fd 3 起，附加输入接在输出之后，与 ffmpegTranscoder 的 ExtraFiles 顺序一致
+func TestExtraInputArgs(t *testing.T) {
+	mosaic := &MosaicConfig{Tiles: []MosaicTile{{StreamPath: "live/a"}, {StreamPath: "live/b"}, {StreamPath: "live/a"}, {StreamPath: "live/c"}}}
+	tests := []struct {
+		name     string
+		config   StreamConfig
+		pipeOuts int
+		want     string
+		n        int
+	}{
+		{"pip", StreamConfig{TransType: TransTypePip, Pip: &PipConfig{StreamPath: "live/b"}, inputLive: map[string]bool{"live/b": true}}, 1, "-re -i pipe:3", 1},
+		{"pip lost", StreamConfig{TransType: TransTypePip, Pip: &PipConfig{StreamPath: "live/b"}}, 1, "", 0},
+		{"pushonly", StreamConfig{TransType: TransTypePip, Pip: &PipConfig{StreamPath: "live/b"}, inputLive: map[string]bool{"live/b": true}}, 0, "-re -i pipe:3", 1},
+		{"mosaic", StreamConfig{TransType: TransTypeMosaic, Mosaic: mosaic, inputLive: map[string]bool{"live/a": true, "live/c": true}}, 1, "-re -i pipe:3 -re -i pipe:4", 2},
+		{"after outputs", StreamConfig{TransType: TransTypeMosaic, Mosaic: mosaic, inputLive: map[string]bool{"live/a": true, "live/b": true}}, 3, "-re -i pipe:5 -re -i pipe:6", 2},
+	}
+	for _, test := range tests {
+		args, n := extraInputArgs(&test.config, test.pipeOuts)
+		if got := strings.Join(args, " "); got != test.want || n != test.n {
+			t.Errorf("%s: extraInputArgs = %q %d, want %q %d", test.name, got, n, test.want, test.n)
+		}
+	}
+
+	config := StreamConfig{TransType: TransTypeMosaic, Mosaic: mosaic, inputLive: map[string]bool{"live/b": true, "live/c": true}}
+	for path, want := range map[string]int{"live/b": 0, "live/c": 1} {
+		if i, ok := extraInputIndex(&config, path); !ok || i != want {
+			t.Errorf("extraInputIndex(%s) = %d %v, want %d", path, i, ok, want)
+		}
+	}
+	if _, ok := extraInputIndex(&config, "live/a"); ok {
+		t.Error("lost source has an input index")
+	}
+}
+
+// 不支持 fd 3 起的管道时（windows），需要它们的任务在校验时拒绝
+func TestExtraPipesUnsupported(t *testing.T) {
+	defer func() { extraPipesSupported = true }()
+	conf := &TransformConfig{}
+	renditions := []Rendition{{Name: "720", Resolution: "1280*720"}, {Name: "360", Resolution: "640*360"}}
+	tests := []struct {
+		name   string
+		config StreamConfig
+		ok     bool
+	}{
+		{"ladder", StreamConfig{TransType: TransTypeLadder, Renditions: renditions}, false},
+		{"ladder one rendition", StreamConfig{TransType: TransTypeLadder, Renditions: renditions[:1]}, true},
+		{"pip", StreamConfig{TransType: TransTypePip, Pip: &PipConfig{StreamPath: "live/b", Anchor: "topright", Size: 0.25}}, false},
+		{"mosaic", StreamConfig{TransType: TransTypeMosaic, Mosaic: &MosaicConfig{Tiles: []MosaicTile{{StreamPath: "live/a"}, {StreamPath: "live/b"}}}}, false},
+		{"pipe", StreamConfig{TransType: TransTypePipe}, true},
+	}
+	for _, tt := range tests {
+		config := tt.config
+		config.StreamPath, config.NewStreamPath, config.Resolution = "live/a", "test/a", "1280*720"
+		conf.SetDefaultStreamConfig(&config)
+		extraPipesSupported = true
+		if err := validateStreamConfig(&config); err != nil {
+			t.Errorf("%s: validate with extra pipes = %v", tt.name, err)
+		}
+		extraPipesSupported = false
+		if err := validateStreamConfig(&config); (err == nil) != tt.ok {
+			t.Errorf("%s: validate = %v", tt.name, err)
+		}
+	}
+}
+
+// 占位画面只在附加输入没有画面时加入滤镜图
+func TestPlaceholderOnlyWhenLost(t *testing.T) {
+	conf := &TransformConfig{Fontfile: "font.ttf"}
+	pip := StreamConfig{TransType: TransTypePip, Resolution: "1280*720", Fps: "25", Pip: &PipConfig{StreamPath: "live/b", Anchor: "topright", Size: 0.25, Placeholder: "NO SIGNAL"}}
+	mosaic := StreamConfig{TransType: TransTypeMosaic, Resolution: "1280*720", Fps: "25", Mosaic: &MosaicConfig{Layout: "2x1", Tiles: []MosaicTile{{StreamPath: "live/a"}, {StreamPath: "live/b"}}, Placeholder: "NO SIGNAL"}}
+	tests := []struct {
+		name   string
+		config StreamConfig
+		live   map[string]bool
+		colors int //占位画面的 color 源个数
+	}{
+		{"pip live", pip, map[string]bool{"live/b": true}, 0},
+		{"pip lost", pip, nil, 1},
+		{"mosaic live", mosaic, map[string]bool{"live/a": true, "live/b": true}, 0},
+		{"mosaic one lost", mosaic, map[string]bool{"live/a": true}, 1},
+	}
+	for _, tt := range tests {
+		config := tt.config
+		config.inputLive = tt.live
+		g := newFilterGraph("0:v")
+		if config.TransType == TransTypePip {
+			conf.pipFilter(g, &config)
+		} else {
+			conf.mosaicFilter(g, &config)
+		}
+		g.Output("out")
+		if got := strings.Count(g.String(), "color=c=0x202020"); got != tt.colors {
+			t.Errorf("%s: %d placeholders, want %d: %s", tt.name, got, tt.colors, g.String())
+		}
+	}
+}
@@ -3,17 +3,22 @@ package transform
 import (
 	_ "embed"
 	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"os"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"log"
 	"net/http"
-	"os/exec"
+	"net/url"
+	"reflect"
+	"regexp"
 	"strconv"
+	"strings"
 
 	"go.uber.org/zap"
 	. "m7s.live/engine/v4"
@@ -24,6 +29,7 @@ import (
 var defaultYaml DefaultYaml
 
 var tanfsTaskArray = make(map[string]*TransformTask)
+var tanfsTaskLock sync.RWMutex
 
 type TransformConfig struct {
 	DefaultYaml
@@ -33,9 +39,22 @@ type TransformConfig struct {
 	Path     string //存储路径
 	Filter   string //过滤器
 	Fontfile string `default:"shoujin.ttf" desc:"叠加字体路径 "` //osd 叠加字帖路径   shoujin.ttf
+
+	Backend   string `default:"ffmpeg" desc:"转码引擎 ffmpeg gstreamer"`
+	Gstreamer string `default:"gst-launch-1.0" desc:"gst-launch的路径"`
+
+	StallTimeout time.Duration `default:"10s" desc:"转码进度停止多久视为卡死并重启 ffmpeg，0 为不检测"`
+
+	CodecFallback []string `yaml:"codecfallback" desc:"编码器不可用时依次尝试的编码器"`
+
+	EnhanceProfiles map[string]Enhance `yaml:"enhanceprofiles" desc:"画质增强预设，任务以 enhanceprofile 引用"`
 	//OnStart  []string `desc:"启动时转码的列表"`                      // 启动时转码的列表
 
 	OnStart []StreamConfig `yaml:"onstart"`
+
+	reloadLock     sync.Mutex
+	lastReload     *ReloadReport           //最近一次热加载 onstart 的差异
+	onStartApplied map[string]StreamConfig //onstart 中各转码流最近一次生效的配置，热加载时与之比对，不受 API 运行时修改的影响
 }
 
 // 用此包解析yaml文件到结构体存在三个问题。
@@ -43,14 +62,34 @@ type TransformConfig struct {
 //     没有默认值。
 //     没有数值校验。
 
+// 转码类型
+const (
+	TransTypePipe   = 0 //订阅裸流管道输入，转码后 ts 流发布
+	TransTypeRtsp   = 1 //拉取本机 rtsp，转码后推送本机 rtmp
+	TransTypeRtmp   = 2 //订阅裸流管道输入，转码后推送本机 rtmp
+	TransTypeLadder = 3 //订阅裸流管道输入，一次解码输出多档分辨率，分别发布
+	TransTypePtz    = 4 //订阅裸流管道输入，数字云台裁剪区域可实时移动，ts 流发布
+	TransTypePip    = 5 //订阅主画面和小画面两路裸流，画中画合成后 ts 流发布
+	TransTypeMosaic = 6 //订阅多路裸流拼接成一个画面，ts 流发布
+	TransTypePull   = 7 //ffmpeg 拉取外部地址，转码后 ts 流发布
+	TransTypeFile   = 8 //ffmpeg 循环读取本地文件，转码后 ts 流发布
+)
+
 type StreamConfig struct {
-	TransType     int    `default:"2" yaml:"transtype"` //转码类型  0: rtsp pull rtmp push; 1: sub raw frame rtmp push; 2: sub raw frame  ts publiser;
+	TransType     int    `default:"2" yaml:"transtype"` //转码类型 见 TransTypePipe 等
 	StreamPath    string `default:"" yaml:"streampath"`
 	NewStreamPath string `default:"" yaml:"newstreampath"`
-	Resolution    string `default:"720*576" yaml:"resolution"`
+	Resolution    string `default:"max:720*576" yaml:"resolution"` //见 parseResolution
+	Pad           bool   `default:"false" yaml:"pad"`              //保持宽高比，加黑边补足到固定尺寸
+
+	Crop   string `yaml:"crop"`   //裁剪区域 w*h+x+y，省略 +x+y 时居中
+	Rotate int    `yaml:"rotate"` //顺时针旋转 0 90 180 270
+	HFlip  bool   `yaml:"hflip"`  //水平翻转
+	VFlip  bool   `yaml:"vflip"`  //垂直翻转
 
 	VideoCodec string `default:"libx264" yaml:"videocodec"` //libx264, libx265
 	Fps        string `default:"25" yaml:"fps"`
+	Bitrate    string `default:"" yaml:"bitrate"` //输出码率 eg:400k，为空时由编码器决定
 
 	HasOsd       bool   `default:"false" yaml:"hasosd"`
 	OsdText      string `default:"M7S 转码" yaml:"osdtext"`
@@ -60,11 +99,115 @@ type StreamConfig struct {
 	OsdY         int    `default:"50" yaml:"osdy"`
 	OsdBox       int    `default:"1" yaml:"osdbox"`
 	OsdBoxcolor  string `default:"yellow" yaml:"osdboxcolor"`
+	OsdLive      bool   `default:"false" yaml:"osdlive"` //osd 文字从文件读取，可通过 /transform/osd 实时修改
+
+	Renditions []Rendition `yaml:"renditions"` //多码率阶梯的各档，仅 transtype 3
+
+	Logos      []Logo      `yaml:"logos"`      //图片台标，可以有多个
+	TextLayers []TextLayer `yaml:"textlayers"` //文字叠加层，可以有多个，支持变量
+	Ticker     *Ticker     `yaml:"ticker"`     //滚动字幕
+	Masks      []Mask      `yaml:"masks"`      //隐私遮挡区域
+
+	EnhanceProfile string     `yaml:"enhanceprofile"` //画质增强预设名
+	Enhance        *Enhance   `yaml:"enhance"`        //画质增强，覆盖预设中的同名项
+	Stabilize      *Stabilize `yaml:"stabilize"`      //防抖
+
+	Ptz     *PtzConfig `yaml:"ptz"` //数字云台，仅 transtype 4
+	ptzAddr string     //运行时分配的 zmq 滤镜地址
+
+	Pip       *PipConfig      `yaml:"pip"`    //画中画，仅 transtype 5
+	Mosaic    *MosaicConfig   `yaml:"mosaic"` //画面拼接，仅 transtype 6
+	inputLive map[string]bool //运行时各路附加输入是否有画面
+
+	Slate       *SlateConfig `yaml:"slate"` //源中断时的垫片
+	slateActive bool         //运行时源中断，正在输出垫片
+
+	Failover *FailoverConfig `yaml:"failover"` //备用源，源流中断时切换
+
+	Pull *PullConfig `yaml:"pull"` //拉取的外部地址，仅 transtype 7
+	File *FileConfig `yaml:"file"` //循环播放的本地文件，仅 transtype 8
+
+	textID string //运行时实时文字文件的编号，即任务编号
+
+	Push       []PushOutput `yaml:"push"`     //推送到的外部地址，可以有多个
+	PushOnly   bool         `yaml:"pushonly"` //只推送到外部地址，不在本机发布转码流
+	pushActive []bool       //运行时各外部地址是否包含在本次命令中，失败后等待重试时不包含
+}
+
+// 深拷贝，补全默认值会修改指针指向的配置，onstart 列表和运行中的任务不能共用
+func (c StreamConfig) clone() StreamConfig {
+	n := c
+	n.Renditions = append([]Rendition(nil), c.Renditions...)
+	n.Logos = append([]Logo(nil), c.Logos...)
+	n.TextLayers = append([]TextLayer(nil), c.TextLayers...)
+	n.Masks = append([]Mask(nil), c.Masks...)
+	n.Push = append([]PushOutput(nil), c.Push...)
+	if c.Ticker != nil {
+		ticker := *c.Ticker
+		n.Ticker = &ticker
+	}
+	if c.Enhance != nil {
+		enhance := *c.Enhance
+		n.Enhance = &enhance
+	}
+	if c.Stabilize != nil {
+		stabilize := *c.Stabilize
+		n.Stabilize = &stabilize
+	}
+	if c.Ptz != nil {
+		ptz := *c.Ptz
+		if c.Ptz.Presets != nil {
+			ptz.Presets = make(map[string]PtzPosition, len(c.Ptz.Presets))
+			for name, pos := range c.Ptz.Presets {
+				ptz.Presets[name] = pos
+			}
+		}
+		n.Ptz = &ptz
+	}
+	if c.Pip != nil {
+		pip := *c.Pip
+		n.Pip = &pip
+	}
+	if c.Mosaic != nil {
+		mosaic := *c.Mosaic
+		mosaic.Tiles = append([]MosaicTile(nil), c.Mosaic.Tiles...)
+		for i := range mosaic.Tiles {
+			mosaic.Tiles[i].Cell = append([]int(nil), mosaic.Tiles[i].Cell...)
+		}
+		n.Mosaic = &mosaic
+	}
+	if c.Slate != nil {
+		slate := *c.Slate
+		n.Slate = &slate
+	}
+	if c.Failover != nil {
+		failover := *c.Failover
+		failover.Backups = append([]string(nil), c.Failover.Backups...)
+		n.Failover = &failover
+	}
+	if c.Pull != nil {
+		pull := *c.Pull
+		n.Pull = &pull
+	}
+	if c.File != nil {
+		file := *c.File
+		n.File = &file
+	}
+	return n
+}
+
+// 多码率阶梯中的一档，发布到 newstreampath/name
+type Rendition struct {
+	Name       string `yaml:"name"` //eg: 1080 720 360
+	Resolution string `yaml:"resolution"`
+	Bitrate    string `yaml:"bitrate"`
 }
 
 type TransformTask struct {
 	plugin *TransformConfig
+	id     string //任务编号，创建时分配，实时文字文件以此命名
 
+	//状态和统计由订阅、输出、任务等多个线程更新，都在 mt 下读写
 	status int //0 :idel ; 1 input ing; 2 output ing
 
 	//统计信息
@@ -73,35 +216,63 @@ type TransformTask struct {
 
 	streamConfig StreamConfig
 
-	atTime time.Time //开始时间
-	cmd    *exec.Cmd
+	atTime     time.Time //开始时间
+	transcoder Transcoder
 
-	p *TransformPublisher
 	s *TransformSubscriber
 
-	//两个管道一个输入
+	//一个输入管道，多个输出管道
 	in_wp    io.WriteCloser
 	in_bytes int
 
-	out_rp    io.ReadCloser
-	out_bytes int
+	publishers  map[string]*TransformPublisher //发布地址 → 发布者，ffmpeg 原地重启时保留
+	publishFail map[string]*publishRetry       //发布失败的地址，退避后再试
+	outputPaths [][]string                     //每路 ts 输出管道对应的发布地址
+	out_bytes   int
 
 	mt sync.Mutex
 
 	f *os.File
+
+	callers    map[string]bool //共用本任务的转码流地址 → 是否由 onstart 启动
+	exit       bool            //任务已被要求结束
+	exitReason string          //结束原因
+	done       chan struct{}   //任务结束后关闭
+
+	keepStreams  bool                  //只重启 ffmpeg，保留订阅者和发布者
+	paramSets    [][]byte              //缓存的 SPS PPS，ffmpeg 原地重启后补发
+	source       SourceInfo            //从 SPS 解析的源尺寸，未收到时为零值
+	ptz          *ptzState             //数字云台状态，仅 transtype 4
+	extraInputs  []*extraInput         //主输入之外的订阅输入，如画中画的小画面
+	sourceInputs []*extraInput         //配置了垫片或备用源时由它们订阅源流和备用源，检测中断
+	activeSource int                   //正在使用的源流在 sourceInputs 中的序号
+	pushStates   map[string]*pushState //外部地址 → 推送状态
 }
 
+// 发布失败后的退避
+type publishRetry struct {
+	failures int
+	retryAt  time.Time
+}
+
+// 连续发布失败时重试间隔从 1 秒加倍到这个值
+const publishMaxRetryDelay = 30 * time.Second
+
 type TransformPublisher struct {
 	TSPublisher
 	tsReader *TSReader
 	task     *TransformTask
+	path     string //发布地址
+
+	//ffmpeg 的 ts 输出写入 pw，发布者从另一端读取，ffmpeg 重启不影响发布者
+	pw *io.PipeWriter
 }
 
 func (p *TransformPublisher) Delete() {
-	p.Stop()
-	if p.tsReader != nil {
-		p.tsReader.Close()
+	if p.pw != nil {
+		p.pw.Close()
 	}
+	taskEngine.Unpublish(p)
 }
 
 func (p *TransformPublisher) OnEvent(event any) {
@@ -124,15 +295,15 @@ func (t *TransformConfig) OnEvent(event any) {
 		log.Println("TransformConfig OnEvent IPublisher...")
 	case FirstConfig:
 		log.Println("transform FirstConfig")
-		for _, stream := range t.OnStart {
-			t.SetUpTransformTask(stream)
-		}
+		t.probeFfmpeg()
+		t.startOnStart()
 		break
 	case config.Config:
 		log.Println("transform config.Config")
+		t.reloadOnStart()
 		break
 	case SEclose:
-		log.Println("transform SEclose:%s", v.Target.Path)
+		log.Printf("transform SEclose:%s", v.Target.Path)
 		break
 		// case SEpublish:
 		// 	log.Println("transform SEpublish:%s", v.Stream.Path)
@@ -149,11 +320,27 @@ var TransformPlugin = InstallPlugin(conf)
 func (t *TransformConfig) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	//streamPath := strings.TrimPrefix(r.RequestURI, "/transform/")
 
-	streamConfig := StreamConfig{
+	streamConfig := apiStreamConfig()
+	if err := parseStreamConfig(r.URL.Query(), &streamConfig); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := t.SetUpTransformTask(streamConfig); err != nil {
+		http.Error(w, err.Error(), setUpStatus(err))
+		return
+	}
+
+	w.Write([]byte("ok"))
+}
+
+// API 添加任务时的默认配置
+func apiStreamConfig() StreamConfig {
+	return StreamConfig{
 		TransType:     0,
 		StreamPath:    "",
 		NewStreamPath: "",
-		Resolution:    "352*288", //CIF 352*288 qcif 176×144 320*240  1280*720
+		Resolution:    "max:352*288", //CIF 352*288 qcif 176×144 320*240  1280*720
 		Fps:           "25",
 		VideoCodec:    "libx264", //libx264,libx265
 
@@ -166,52 +353,151 @@ func (t *TransformConfig) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		OsdBox:       0,
 		OsdBoxcolor:  "yellow",
 	}
+}
 
-	streamPath := r.URL.Query().Get("streampath")
-	streamConfig.StreamPath = streamPath
+// 把请求参数中出现的项覆盖到 config，未出现的保持原值
+func parseStreamConfig(query url.Values, config *StreamConfig) (err error) {
+	atoi := func(key string, v *int) {
+		if err == nil && query.Has(key) {
+			if *v, err = strconv.Atoi(query.Get(key)); err != nil {
+				err = fmt.Errorf("invalid %s: %s", key, query.Get(key))
+			}
+		}
+	}
 
-	transType, err := strconv.Atoi(r.URL.Query().Get("transtype"))
-	if err == nil {
-		streamConfig.TransType = transType
+	if query.Has("streampath") {
+		config.StreamPath = query.Get("streampath")
 	}
+	atoi("transtype", &config.TransType)
 	//输出分辨率
-	if r.URL.Query().Has("resolution") {
-		streamConfig.Resolution = r.URL.Query().Get("resolution")
+	if query.Has("resolution") {
+		config.Resolution = query.Get("resolution")
+	}
+	if query.Has("pad") {
+		config.Pad = query.Get("pad") == "1"
+	}
+	//安装方向
+	if query.Has("crop") {
+		config.Crop = query.Get("crop")
+	}
+	atoi("rotate", &config.Rotate)
+	for key, v := range map[string]*bool{"hflip": &config.HFlip, "vflip": &config.VFlip} {
+		if err == nil && query.Has(key) {
+			*v, err = parseBool(key, query.Get(key))
+		}
 	}
 	//输出编码格式
-	if r.URL.Query().Has("videocodec") {
-		streamConfig.VideoCodec = r.URL.Query().Get("videocodec")
+	if query.Has("videocodec") {
+		config.VideoCodec = query.Get("videocodec")
 	}
-	//输出分辨率
-	if r.URL.Query().Has("fps") {
-		streamConfig.Fps = r.URL.Query().Get("fps")
+	//输出帧率
+	if query.Has("fps") {
+		config.Fps = query.Get("fps")
 	}
-
-	if r.URL.Query().Has("osdtext") {
-		streamConfig.OsdText = r.URL.Query().Get("osdtext")
-		streamConfig.HasOsd = true
+	//输出码率
+	if query.Has("bitrate") {
+		config.Bitrate = query.Get("bitrate")
 	}
 
-	if r.URL.Query().Has("osdx") {
-		streamConfig.OsdX, err = strconv.Atoi(r.URL.Query().Get("osdx"))
+	if query.Has("osdtext") {
+		config.OsdText = query.Get("osdtext")
+		config.HasOsd = true
 	}
-	if r.URL.Query().Has("osdy") {
-		streamConfig.OsdY, err = strconv.Atoi(r.URL.Query().Get("osdy"))
+	if query.Has("osdfontcolor") {
+		config.OsdFontColor = query.Get("osdfontcolor")
 	}
-	if r.URL.Query().Has("osdboxcolor") {
-		streamConfig.OsdBoxcolor = r.URL.Query().Get("osdboxcolor")
+	atoi("osdfontsize", &config.OsdFontsize)
+	atoi("osdx", &config.OsdX)
+	atoi("osdy", &config.OsdY)
+	if query.Has("osdboxcolor") {
+		config.OsdBoxcolor = query.Get("osdboxcolor")
 	}
-	if r.URL.Query().Has("osdbox") {
-		streamConfig.OsdBox, err = strconv.Atoi(r.URL.Query().Get("osdbox"))
+	atoi("osdbox", &config.OsdBox)
+	if query.Has("osdlive") {
+		config.OsdLive = query.Get("osdlive") == "1"
 	}
 
-	if r.URL.Query().Has("newstreampath") {
-		streamConfig.NewStreamPath = r.URL.Query().Get("newstreampath")
+	if query.Has("newstreampath") {
+		config.NewStreamPath = query.Get("newstreampath")
 	}
-
-	t.SetUpTransformTask(streamConfig)
-
-	w.Write([]byte("ok"))
+	if err == nil && query.Has("renditions") {
+		config.Renditions, err = parseRenditions(query.Get("renditions"))
+	}
+	if err == nil && query.Has("texts") {
+		config.TextLayers, err = parseTextLayers(query.Get("texts"))
+	}
+	if query.Has("enhanceprofile") {
+		config.EnhanceProfile = query.Get("enhanceprofile")
+	}
+	if err == nil && query.Has("enhance") {
+		config.Enhance, err = parseEnhance(query.Get("enhance"))
+	}
+	if err == nil && query.Has("stabilize") {
+		config.Stabilize, err = parseStabilize(query.Get("stabilize"))
+	}
+	if err == nil && query.Has("ptz") {
+		config.Ptz = &PtzConfig{}
+		if err = json.Unmarshal([]byte(query.Get("ptz")), config.Ptz); err != nil {
+			err = fmt.Errorf("invalid ptz: %w", err)
+		}
+	}
+	if err == nil && query.Has("pip") {
+		config.Pip, err = parsePip(query.Get("pip"))
+	}
+	if err == nil && query.Has("mosaic") {
+		config.Mosaic, err = parseMosaic(query.Get("mosaic"))
+	}
+	if err == nil && query.Has("slate") {
+		config.Slate = &SlateConfig{}
+		if err = json.Unmarshal([]byte(query.Get("slate")), config.Slate); err != nil {
+			err = fmt.Errorf("invalid slate: %w", err)
+		}
+	}
+	if err == nil && query.Has("failover") {
+		config.Failover = &FailoverConfig{}
+		if err = json.Unmarshal([]byte(query.Get("failover")), config.Failover); err != nil {
+			err = fmt.Errorf("invalid failover: %w", err)
+		}
+	}
+	if err == nil && query.Has("pull") {
+		config.Pull = &PullConfig{}
+		if err = json.Unmarshal([]byte(query.Get("pull")), config.Pull); err != nil {
+			err = fmt.Errorf("invalid pull: %w", err)
+		}
+	}
+	if err == nil && query.Has("file") {
+		config.File = &FileConfig{}
+		if err = json.Unmarshal([]byte(query.Get("file")), config.File); err != nil {
+			err = fmt.Errorf("invalid file: %w", err)
+		}
+	}
+	if err == nil && query.Has("push") {
+		config.Push = nil
+		if err = json.Unmarshal([]byte(query.Get("push")), &config.Push); err != nil {
+			err = fmt.Errorf("invalid push: %w", err)
+		}
+	}
+	if query.Has("pushonly") {
+		config.PushOnly = query.Get("pushonly") == "1"
+	}
+	if err == nil && query.Has("masks") {
+		config.Masks, err = parseMasks(query.Get("masks"))
+	}
+	if err == nil && query.Has("ticker") {
+		config.Ticker, err = parseTicker(query.Get("ticker"))
+	}
+	//台标可以有多个 logo=logo.png,topright,10,10
+	if err == nil && query.Has("logo") {
+		config.Logos = nil
+		for _, s := range query["logo"] {
+			var logo Logo
+			if logo, err = parseLogo(s); err != nil {
+				break
+			}
+			config.Logos = append(config.Logos, logo)
+		}
+	}
+	return
 }
 
 func (t *TransformConfig) SetDefaultStreamConfig(config *StreamConfig) {
@@ -237,8 +523,9 @@ func (t *TransformConfig) SetDefaultStreamConfig(config *StreamConfig) {
 		config.Fps = "25"
 	}
 
+	//默认不放大
 	if config.Resolution == "" {
-		config.Resolution = "352*288"
+		config.Resolution = "max:352*288"
 	}
 
 	if config.VideoCodec == "" {
@@ -269,182 +556,485 @@ func (t *TransformConfig) SetDefaultStreamConfig(config *StreamConfig) {
 		config.OsdBoxcolor = "yellow"
 	}
 
+	defaultPtzConfig(config)
+	defaultPipConfig(config)
+	defaultMosaicConfig(config)
+	defaultSlateConfig(config)
+	defaultFailoverConfig(config)
+	defaultPullConfig(config)
+}
+
+var (
+	bitrateRegexp = regexp.MustCompile(`^\d+[kKmM]?$`)
+)
+
+// 校验补全默认值后的配置
+func validateStreamConfig(config *StreamConfig) error {
+	res, err := parseResolution(config.Resolution)
+	if err != nil {
+		return err
+	}
+	if config.Pad && !res.boxed() && config.TransType != TransTypeLadder {
+		return errors.New("pad requires a w*h or max:w*h resolution")
+	}
+	if fps, err := strconv.ParseFloat(config.Fps, 64); err != nil || fps <= 0 {
+		return fmt.Errorf("invalid fps: %s", config.Fps)
+	}
+	if config.Bitrate != "" && !bitrateRegexp.MatchString(config.Bitrate) {
+		return fmt.Errorf("invalid bitrate: %s", config.Bitrate)
+	}
+	if config.OsdFontsize < 0 || config.OsdX < 0 || config.OsdY < 0 {
+		return errors.New("osd fontsize and position must not be negative")
+	}
+	if err := validateOrient(config); err != nil {
+		return err
+	}
+	if err := validatePtz(config); err != nil {
+		return err
+	}
+	if err := validatePip(config); err != nil {
+		return err
+	}
+	if err := validateMosaic(config); err != nil {
+		return err
+	}
+	if err := validateSlate(config); err != nil {
+		return err
+	}
+	if err := validateFailover(config); err != nil {
+		return err
+	}
+	if err := validatePull(config); err != nil {
+		return err
+	}
+	if err := validateFile(config); err != nil {
+		return err
+	}
+	if err := validatePush(config); err != nil {
+		return err
+	}
+	if config.Enhance != nil {
+		if err := validateEnhance(config.Enhance); err != nil {
+			return err
+		}
+	}
+	if config.Stabilize != nil {
+		if err := validateStabilize(config.Stabilize); err != nil {
+			return err
+		}
+	}
+	for i := range config.Logos {
+		if err := validateLogo(&config.Logos[i]); err != nil {
+			return err
+		}
+	}
+	for i := range config.TextLayers {
+		if err := validateTextLayer(&config.TextLayers[i], config); err != nil {
+			return err
+		}
+	}
+	for i := range config.Masks {
+		if err := validateMask(&config.Masks[i]); err != nil {
+			return err
+		}
+	}
+	if config.Ticker != nil {
+		if err := validateTicker(config.Ticker); err != nil {
+			return err
+		}
+	}
+	if config.TransType == TransTypeLadder {
+		if len(config.Renditions) == 0 {
+			return errors.New("renditions is empty")
+		}
+		//第二档起的输出管道从 fd 3 开始
+		if len(config.Renditions) > 1 {
+			if err := checkExtraPipes(config); err != nil {
+				return err
+			}
+		}
+		names := make(map[string]bool)
+		for _, r := range config.Renditions {
+			if r.Name == "" || names[r.Name] {
+				return fmt.Errorf("invalid rendition name: %q", r.Name)
+			}
+			names[r.Name] = true
+			res, err := parseResolution(r.Resolution)
+			if err != nil {
+				return fmt.Errorf("invalid rendition resolution: %s", r.Resolution)
+			}
+			if config.Pad && !res.boxed() {
+				return errors.New("pad requires a w*h or max:w*h resolution")
+			}
+			if r.Bitrate != "" && !bitrateRegexp.MatchString(r.Bitrate) {
+				return fmt.Errorf("invalid rendition bitrate: %s", r.Bitrate)
+			}
+		}
+	}
+	return nil
+}
+
+// 1080:1920*1080:4000k,720:1280*720:2000k  码率可省略
+func parseRenditions(s string) ([]Rendition, error) {
+	var renditions []Rendition
+	for _, item := range strings.Split(s, ",") {
+		fields := strings.Split(item, ":")
+		if len(fields) < 2 || len(fields) > 3 {
+			return nil, fmt.Errorf("invalid rendition: %s", item)
+		}
+		r := Rendition{Name: fields[0], Resolution: fields[1]}
+		if len(fields) == 3 {
+			r.Bitrate = fields[2]
+		}
+		renditions = append(renditions, r)
+	}
+	return renditions, nil
+}
+
+func (t *TransformConfig) SetUpTransformTask(config StreamConfig) error {
+	_, err := t.setUpTransformTask(config, false)
+	return err
 }
 
-func (t *TransformConfig) SetUpTransformTask(config StreamConfig) {
+// 补全默认配置并推导出转码流地址
+func (t *TransformConfig) resolveStreamConfig(config *StreamConfig) error {
 	//更新默认配置
-	t.SetDefaultStreamConfig(&config)
+	t.SetDefaultStreamConfig(config)
+
+	//画面拼接的源在 mosaic.tiles 中，拉取外部地址的源在 pull.url 中，本地文件在 file.path 中，只需要转码流地址
+	needStreamPath := config.TransType != TransTypeMosaic && config.TransType != TransTypePull && config.TransType != TransTypeFile
+	if config.StreamPath == "" && (needStreamPath || config.NewStreamPath == "") {
+		return errors.New("streampath is empty")
+	}
+	if err := t.resolveEnhance(config); err != nil {
+		return err
+	}
+	if err := validateStreamConfig(config); err != nil {
+		return err
+	}
+	if err := t.checkLogos(config); err != nil {
+		return err
+	}
+	if err := t.checkSlate(config); err != nil {
+		return err
+	}
+	if err := t.checkPull(config); err != nil {
+		return err
+	}
+	if err := t.checkFile(config); err != nil {
+		return err
+	}
+	if err := t.checkCapability(config); err != nil {
+		return err
+	}
+	transcoder, err := t.newTranscoder()
+	if err != nil {
+		return err
+	}
+	if _, err := transcoder.Argv(config); err != nil {
+		return err
+	}
+
+	if config.NewStreamPath == "" {
+		typeStr := strconv.FormatInt(int64(config.TransType), 10)
+		config.NewStreamPath = config.StreamPath + "-ts" + typeStr
+	}
+	return nil
+}
+
+var taskSeq uint64
+
+// 进程号加序号，多个实例共用 path 时也不重复
+func newTaskID() string {
+	return fmt.Sprintf("%d-%d", os.Getpid(), atomic.AddUint64(&taskSeq, 1))
+}
+
+func (t *TransformConfig) setUpTransformTask(config StreamConfig, fromOnStart bool) (*TransformTask, error) {
+	if err := t.resolveStreamConfig(&config); err != nil {
+		TransformPlugin.Info("stream transform invalid\n", zap.String("streamPath", config.StreamPath))
+		return nil, err
+	}
 
 	task := &TransformTask{
 		plugin:       t,
+		id:           newTaskID(),
 		streamConfig: config,
+		callers:      map[string]bool{config.NewStreamPath: fromOnStart},
+		done:         make(chan struct{}),
 	}
 
-	if task.streamConfig.StreamPath == "" {
-		TransformPlugin.Info("stream transform invalid\n", zap.String("streamPath", task.streamConfig.StreamPath))
-		return
-	}
-
-	if task.streamConfig.NewStreamPath == "" {
-		typeStr := strconv.FormatInt(int64(task.streamConfig.TransType), 10)
-		task.streamConfig.NewStreamPath = task.streamConfig.StreamPath + "-ts" + typeStr
+	if config.TransType == TransTypePtz {
+		ptz, err := newPtzState(config.Ptz.position())
+		if err != nil {
+			return nil, err
+		}
+		task.ptz = ptz
 	}
 
+	tanfsTaskLock.Lock()
 	if tanfsTaskArray[task.streamConfig.NewStreamPath] != nil {
+		tanfsTaskLock.Unlock()
 		TransformPlugin.Info("stream transform\n", zap.String("streamPath", task.streamConfig.NewStreamPath))
-		return
+		return nil, fmt.Errorf("stream %s is already transforming", task.streamConfig.NewStreamPath)
+	}
+	//相同的转码已在运行，作为调用者加入
+	if shared := findSharedTask(&config); shared != nil {
+		shared.addCaller(config.NewStreamPath, fromOnStart)
+		tanfsTaskArray[config.NewStreamPath] = shared
+		tanfsTaskLock.Unlock()
+		TransformPlugin.Info("share transform task", zap.String("newStreamPath", config.NewStreamPath), zap.Strings("callers", shared.callerPaths()))
+		shared.syncPublishers()
+		return shared, nil
+	}
+	if err := checkPushConflict(&config, nil); err != nil {
+		tanfsTaskLock.Unlock()
+		return nil, err
 	}
-
 	task.atTime = time.Now()
 	tanfsTaskArray[task.streamConfig.NewStreamPath] = task
+	tanfsTaskLock.Unlock()
 
-	switch task.streamConfig.TransType {
-	case 0:
-		go task.setupFfmpegTransformThrd0()
-	case 1:
-		go task.setupFfmpegTransformThrd1()
-	case 2:
-		go task.setupFfmpegTransformThrd2()
+	go task.run()
+
+	return task, nil
+}
+
+// 要求任务结束，ffmpeg 进程退出后由任务线程完成清理
+func (t *TransformTask) stop(reason string) {
+	t.mt.Lock()
+	t.exit = true
+	t.exitReason = reason
+	transcoder := t.transcoder
+	t.mt.Unlock()
+
+	if transcoder != nil {
+		transcoder.Stop()
 	}
+}
 
-	return
+func (t *TransformTask) exiting() bool {
+	t.mt.Lock()
+	defer t.mt.Unlock()
+	return t.exit
+}
 
+// 只重启 ffmpeg 进程，订阅者和发布者保持不变，转码流地址不会中断
+func (t *TransformTask) restartFF(reason string) {
+	t.mt.Lock()
+	t.keepStreams = true
+	transcoder := t.transcoder
+	newStreamPath := t.streamConfig.NewStreamPath
+	t.mt.Unlock()
+
+	TransformPlugin.Info("restart ffmpeg", zap.String("newStreamPath", newStreamPath), zap.String("reason", reason))
+	if transcoder != nil {
+		transcoder.Stop()
+	}
+}
+
+func (t *TransformTask) config() StreamConfig {
+	t.mt.Lock()
+	defer t.mt.Unlock()
+	return t.streamConfig
+}
+
+// 任务状态和统计
+type taskCounts struct {
+	status         int
+	restartFFCount int
+	rePullCount    int
+	inBytes        int
+	outBytes       int
+}
+
+func (t *TransformTask) counts() taskCounts {
+	t.mt.Lock()
+	defer t.mt.Unlock()
+	return taskCounts{t.status, t.restartFFCount, t.rePullCount, t.in_bytes, t.out_bytes}
+}
+
+// 按源尺寸实际生效的配置，多码率阶梯去掉超过源尺寸的档位
+func (t *TransformTask) effectiveConfig() StreamConfig {
+	t.mt.Lock()
+	defer t.mt.Unlock()
+	config := t.streamConfig
+	if config.TransType == TransTypeLadder {
+		config.Renditions = ladderRenditions(config.Renditions, t.source)
+	}
+	t.ptzConfig(&config)
+	config.inputLive = t.inputsLive()
+	config.slateActive = config.Slate != nil && t.sourceDown()
+	config.pushActive = t.pushActive(&config)
+	config.textID = t.id
+	if t.plugin.Backend == "gstreamer" {
+		config.Resolution = gstResolution(config.Resolution, t.source)
+	}
+	return config
+}
+
+// 收到源的 SPS，生效的档位变化时原地重启 ffmpeg
+func (t *TransformTask) setSource(source SourceInfo) {
+	before := t.effectiveConfig()
+	t.mt.Lock()
+	t.source = source
+	t.mt.Unlock()
+	if !reflect.DeepEqual(before, t.effectiveConfig()) {
+		t.restartFF(fmt.Sprintf("source size %dx%d", source.Width, source.Height))
+	}
+}
+
+// 更新任务配置并原地重启 ffmpeg
+func (t *TransformTask) update(config StreamConfig) {
+	t.mt.Lock()
+	t.streamConfig = config
+	t.pushStates = nil //不再重试的外部地址随配置更新重新开始推送
+	t.mt.Unlock()
+	t.syncExtraInputs()
+	t.restartFF("update")
+}
+
+// 任务结束前设为 nil，stop 时不会再结束已退出的进程
+func (t *TransformTask) setTranscoder(transcoder Transcoder) bool {
+	t.mt.Lock()
+	defer t.mt.Unlock()
+	if t.exit && transcoder != nil {
+		return false
+	}
+	t.transcoder = transcoder
+	return true
 }
 
 // 重点方案，增加ffmpeg 进程异常退出重启功能  默认方法
 // 学习stream 码流订阅用法
 // 学习stream 码流发布用法
-func (t *TransformTask) setupFfmpegTransformThrd0() {
-	TransformPlugin.Info("setupFfmpegTransformThrd0 pipe in and out...")
+func (t *TransformTask) run() {
+	config := t.config()
+	TransformPlugin.Info("transform task run", zap.String("newStreamPath", config.NewStreamPath), zap.Int("transType", config.TransType))
 
-	//添加一个循环 避免ffmpeg 进程异常退出，退出后自动重新启动
-	for {
-		t.status = 0
+	t.syncExtraInputs()
 
+	//添加一个循环 避免ffmpeg 进程异常退出，退出后自动重新启动
+	for !t.exiting() {
 		//ffmpeg 启动次数+1
+		t.mt.Lock()
+		t.status = 0
 		t.restartFFCount++
+		t.mt.Unlock()
 
-		osdText := ""
-		//"drawtext=fontsize=100:fontfile=shoujin.ttf:text='m7s转码 ts2':x=500:y=500:fontcolor=green:box=1:boxcolor=yellow",
-
-		if t.streamConfig.OsdText != "" {
-			osdText += fmt.Sprintf("drawtext=fontsize=%d:fontfile=%s:text='%s':x=%d:y=%d:fontcolor=%s",
-				t.streamConfig.OsdFontsize,
-				t.plugin.Fontfile,
-				t.streamConfig.OsdText,
-				t.streamConfig.OsdX,
-				t.streamConfig.OsdY,
-				t.streamConfig.OsdFontColor)
-		}
-
-		if t.streamConfig.OsdBox != 0 && t.streamConfig.OsdBoxcolor != "" {
-			osdText += fmt.Sprintf(":box=1:boxcolor=%s",
-				t.streamConfig.OsdBoxcolor)
-		}
-
-		TransformPlugin.Info(osdText)
-
-		cmd := exec.Command(conf.Ffmpeg, "-re",
-			"-i", "pipe:0",
-			"-tune", "zerolatency", //编码延迟参数
-			//"-vcodec", t.videoCodec,
-			//"-g", "12", "-keyint_min", "12", //设置GOP 大小和关键帧间隔
-			//"-b:v", "400k",
-			//"-preset", "superfast", //编码延迟参数，superfast ultrafast  影响图像质量
-			"-s", t.streamConfig.Resolution,
-			"-r", t.streamConfig.Fps,
-			"-vf",
-			osdText,
-			"-c:v", t.streamConfig.VideoCodec,
-			//"drawtext=fontsize=100:fontfile=shoujin.ttf:text='m7s转码 ts2':x=500:y=500:fontcolor=green:box=1:boxcolor=yellow",
-			//"-acodec", "libfaac",
-			//"-b:a", "64k",
-			"-acodec", "copy",
-			"-f",
-			"mpegts", //TS
-			"pipe:1",
-		)
-
-		TransformPlugin.Info(cmd.String())
-
-		// cmd := exec.Command(conf.Ffmpeg, "-re",
-		// 	"-i", "pipe:0",
-		// 	"-tune", "zerolatency", //编码延迟参数
-		// 	"-vcodec", "libx264",
-		// 	"-g", "12", "-keyint_min", "12", //设置GOP 大小和关键帧间隔
-		// 	"-b:v", "400k",
-		// 	"-preset", "superfast", //编码延迟参数，superfast ultrafast  影响图像质量
-		// 	"-s", "320*240",
-		// 	"-r", "25",
-		// 	"-vf",
-		// 	"drawtext=fontsize=100:fontfile=shoujin.ttf:text='m7s转码 ts2':x=500:y=500:fontcolor=green:box=1:boxcolor=yellow",
-		// 	"-acodec", "libfaac",
-		// 	"-b:a", "64k",
-		// 	"-f",
-		// 	//"h264",
-		// 	//"flv",
-		// 	"mpegts", //TS
-		// 	//"mpeg", //ps
-		// 	"pipe:1",
-		// 	//"-y",
-		// 	//"transform.flv",
-		// )
-
-		//获取输入流
-		stdin, err := cmd.StdinPipe()
-		if err != nil {
-			TransformPlugin.Error("Error getting stdin pipe:", zap.Error(err))
-			continue
+		if t.ptz != nil {
+			if err := t.ptz.checkAddr(); err != nil {
+				TransformPlugin.Error("ptz zmq port", zap.Error(err))
+			}
 		}
+		config := t.effectiveConfig()
+		t.writeTextFiles(&config)
 
-		t.cmd = cmd
-
-		t.in_wp = stdin
-
-		//获取输出流 句柄
-		stdout, err := cmd.StdoutPipe()
-		if err != nil {
-			TransformPlugin.Error("Error getting stdout pipe:", zap.Error(err))
-			continue
+		transcoder, err := t.plugin.newTranscoder()
+		if f, ok := transcoder.(*ffmpegTranscoder); ok {
+			f.onOutputFail = func(slave int, reason string) { t.pushFailed(&config, slave, reason) }
+		}
+		if err == nil {
+			err = transcoder.Start(&config)
 		}
-		t.out_rp = stdout
-
-		// Start the command
-		err = cmd.Start()
 		if err != nil {
 			TransformPlugin.Error("Error starting command:", zap.Error(err))
+			time.Sleep(time.Duration(1000) * time.Millisecond)
 			continue
 		}
+		if !t.setTranscoder(transcoder) {
+			transcoder.Stop()
+			transcoder.Wait()
+			break
+		}
 
-		//优先启动读管道数据进程
-		go t.readFFPipe1AndToPublisher()
+		var inWp io.WriteCloser
+		if inputs := transcoder.Inputs(); len(inputs) > 0 {
+			inWp = inputs[0]
+		}
+		t.mt.Lock()
+		t.in_wp = inWp
+		paramSets := t.paramSets
+		t.mt.Unlock()
+		t.setExtraWriters(&config, transcoder.Inputs())
+		t.pushStarted(&config)
 
-		//定义一个订阅者
-		s := &TransformSubscriber{}
-		//s.IsInternal = true
-		s.task = t
-		t.s = s
+		//优先启动读管道数据进程
+		t.syncPublishers()
+		var readers sync.WaitGroup
+		for i, rp := range transcoder.Outputs() {
+			readers.Add(1)
+			go func(i int, rp io.ReadCloser) {
+				defer readers.Done()
+				t.readFFPipe1AndToPublisher(i, rp)
+			}(i, rp)
+		}
 
-		if err := TransformPlugin.Subscribe(t.streamConfig.StreamPath, s); err != nil {
-			TransformPlugin.Error("TransformPlugin 2 Subscribe faild")
-			continue
+		if inWp == nil {
+			//直接拉流或正在输出垫片，不需要订阅
+		} else if t.sourceInputsActive() {
+			//源流由 sourceInputs 订阅，写入端已由 setExtraWriters 交给正在使用的一路
+			if t.s != nil {
+				t.s.Delete()
+				t.s = nil
+			}
+		} else if t.s != nil {
+			//原地重启，订阅者还在，先补发 SPS PPS
+			for _, buf := range paramSets {
+				t.writeToFFPipe0(buf)
+			}
 		} else {
-			//重点需要goroutin  启动订阅流，且只订阅了video track 裸流
-			//避免重复请求播放
-			if !s.IsPlaying() {
+			//定义一个订阅者
+			s := &TransformSubscriber{}
+			//s.IsInternal = true
+			s.task = t
+			t.s = s
+
+			if err := taskEngine.Subscribe(config.StreamPath, s); err != nil {
+				TransformPlugin.Error("TransformPlugin Subscribe faild", zap.Error(err))
+				transcoder.Stop()
+			} else {
+				//重点需要goroutin  启动订阅流，且只订阅了video track 裸流
 				TransformPlugin.Info("TransformPlugin Subscribe sucess 2 play")
-				go s.PlayRaw()
+				go taskEngine.Play(s)
 			}
 		}
 
+		watched := make(chan struct{})
+		go t.watchStall(transcoder, inWp != nil, watched)
+
 		TransformPlugin.Info("cmd Start  wait end....\n")
-		err = cmd.Wait()
+		err = transcoder.Wait()
+		close(watched)
 		if err != nil {
 			TransformPlugin.Error("Error Wait command:", zap.Error(err))
 		}
+		//进程退出前写出的封装尾部送到发布者后再关闭发布流
+		readers.Wait()
+		t.setTranscoder(nil)
 		//复位读写指针
-		t.out_rp = nil
+		t.mt.Lock()
 		t.in_wp = nil
+		t.mt.Unlock()
+		t.setExtraWriters(&config, nil)
+
+		t.mt.Lock()
+		keepStreams := t.keepStreams && !t.exit
+		t.keepStreams = false
+		t.mt.Unlock()
+		if keepStreams {
+			TransformPlugin.Info("ffmpegTransformThrd restart in place", zap.Int("restartFFCount", t.counts().restartFFCount))
+			continue
+		}
+		//外部地址断流，保留发布者，等待后重新拉取
+		if config.TransType == TransTypePull && !t.exiting() {
+			t.mt.Lock()
+			t.rePullCount++
+			rePullCount := t.rePullCount
+			t.mt.Unlock()
+			TransformPlugin.Info("pull reconnect", zap.String("url", config.Pull.URL), zap.Int("rePullCount", rePullCount))
+			time.Sleep(pullReconnectDelay(&config))
+			continue
+		}
 
 		//关闭订阅流
 		if t.s != nil {
@@ -453,21 +1043,20 @@ func (t *TransformTask) setupFfmpegTransformThrd0() {
 			t.s = nil
 		}
 		//关闭发布流
-		if t.p != nil {
-			t.p.Delete()
-			t.p = nil
-			TransformPlugin.Info("try to close TransformPublisher")
+		t.deletePublishers()
+		if t.exiting() {
+			break
 		}
-		TransformPlugin.Info("ffmpegTransformThrd end to restart", zap.Int("restartFFCount", t.restartFFCount))
+		TransformPlugin.Info("ffmpegTransformThrd end to restart", zap.Int("restartFFCount", t.counts().restartFFCount))
 
 		//延迟后重启
 		time.Sleep(time.Duration(1000) * time.Millisecond)
 
 	}
 
-	//TransformPlugin.Info("ffmpeg task end...")
+	TransformPlugin.Info("ffmpeg task end...")
 
-	//t.taskEnd("ffmpeg cmd end")
+	t.taskEnd("ffmpeg task end")
 }
 
 // 订阅的Track数据写入ffmpeg 输入管道
@@ -489,214 +1078,217 @@ func (t *TransformTask) writeToFFPipe0(buf []byte) {
 	// 		len(buf), hex.EncodeToString(buf[0:n]))
 	// }
 
+	t.mt.Lock()
 	t.status = 1
-	if t.in_wp == nil {
+	wp := t.in_wp
+	if wp != nil {
+		t.in_bytes += len(buf)
+	}
+	t.mt.Unlock()
+	if wp == nil {
 		TransformPlugin.Warn("invalid in pipe wp")
 		return
 	}
-	t.in_bytes += len(buf)
-	_, err := t.in_wp.Write(buf)
+	_, err := wp.Write(buf)
 	if err != nil {
 		TransformPlugin.Error("write to pipe0 failed:", zap.Error(err))
 	}
 }
 
-// ffmpeg 转码后的ts 流  发布 stream
-func (t *TransformTask) readFFPipe1AndToPublisher() {
-	//s.readTsDataFromPipeOut()
-
-	if t.out_rp == nil {
-		//time.Sleep(time.Duration(50) * time.Microsecond)
-		//continue
-		return
+// 按调用者计算各路输出的发布地址，创建缺少的发布者，删除不再需要的
+func (t *TransformTask) syncPublishers() {
+	config := t.effectiveConfig()
+	var outputPaths [][]string
+	wanted := make(map[string]bool)
+	for _, caller := range t.callerPaths() {
+		config.NewStreamPath = caller
+		for i, path := range outputStreamPaths(&config) {
+			if i == len(outputPaths) {
+				outputPaths = append(outputPaths, nil)
+			}
+			outputPaths[i] = append(outputPaths[i], path)
+			wanted[path] = true
+		}
 	}
 
-	if t.p == nil {
-		//发布一个新的转码流
-		//定义一个发布者
-		p := &TransformPublisher{}
-		p.task = t
-		t.p = p
-
-		//判断流是否存在，存在则删除重新发布
-		s := Streams.Get(t.streamConfig.NewStreamPath)
-		if s != nil {
-			Streams.Delete(t.streamConfig.NewStreamPath)
+	var stale []*TransformPublisher
+	t.mt.Lock()
+	t.outputPaths = outputPaths
+	for path, p := range t.publishers {
+		if !wanted[path] {
+			stale = append(stale, p)
+			delete(t.publishers, path)
 		}
-		TransformPlugin.Info("TransformTask TSPublisher", zap.String("newStreamPath", t.streamConfig.NewStreamPath))
-		if err := TransformPlugin.Publish(t.streamConfig.NewStreamPath, p); err != nil {
-			TransformPlugin.Error("TransformTask publish:", zap.Error(err))
-			return
+	}
+	for path := range t.publishFail {
+		if !wanted[path] {
+			delete(t.publishFail, path)
 		}
-		p.AudioTrack = nil
-		p.VideoTrack = nil
+	}
+	t.mt.Unlock()
 
-		//buf := make([]byte, 64*1024)
-		p.tsReader = NewTSReader(&p.TSPublisher)
-		//defer tsReader.Close()
+	for _, p := range stale {
+		TransformPlugin.Info("try to close TransformPublisher", zap.String("streamPath", p.path))
+		p.Delete()
+	}
+	for path := range wanted {
+		t.publisher(path)
+	}
+}
 
-		//很重要这一步
-		//ffmpeg restart t.out_rp 会发生变化
-		if p.TSPublisher.IO.Reader != t.out_rp {
-			TransformPlugin.Info("TSPublisher SetIO...")
-			p.TSPublisher.SetIO(t.out_rp)
-		}
+// 发布地址对应的发布者，不存在时发布一个新的转码流
+func (t *TransformTask) publisher(path string) *TransformPublisher {
+	t.mt.Lock()
+	defer t.mt.Unlock()
+	if p := t.publishers[path]; p != nil {
+		return p
+	}
+	if retry := t.publishFail[path]; retry != nil && time.Now().Before(retry.retryAt) {
+		return nil
 	}
 
-	p := t.p
+	//定义一个发布者
+	p := &TransformPublisher{}
+	p.task = t
+	p.path = path
 
-	for {
-		if t.out_rp == nil {
-			TransformPlugin.Info("TransformTask TSPublisher no out rp valid exit thrd")
-			break
+	TransformPlugin.Info("TransformTask TSPublisher", zap.String("newStreamPath", path))
+	if err := taskEngine.Publish(path, p); err != nil {
+		if t.publishFail == nil {
+			t.publishFail = make(map[string]*publishRetry)
 		}
-		//err := tsReader.Feed(t.out_rp)
-		//很重要这一步
-		if p != nil && p.tsReader != nil {
-			err := p.tsReader.Feed(p)
-			if err == errors.New("file already closed") {
-				TransformPlugin.Error("tsReader.Feed:", zap.Error(err))
-				break
-			}
-			if err != nil {
-				TransformPlugin.Error("tsReader.Feed:", zap.Error(err))
-				//避免循环快速打印
-				time.Sleep(time.Duration(500) * time.Millisecond)
-				//
-			}
-
+		retry := t.publishFail[path]
+		if retry == nil {
+			retry = &publishRetry{}
+			t.publishFail[path] = retry
 		}
-
-		//log.Println("p end Feed...")
+		retry.failures++
+		delay := time.Second << (retry.failures - 1)
+		if delay > publishMaxRetryDelay || delay <= 0 {
+			delay = publishMaxRetryDelay
+		}
+		retry.retryAt = time.Now().Add(delay)
+		TransformPlugin.Error("TransformTask publish:", zap.String("newStreamPath", path),
+			zap.Int("failures", retry.failures), zap.Duration("retry", delay), zap.Error(err))
+		return nil
 	}
+	delete(t.publishFail, path)
 
+	if t.publishers == nil {
+		t.publishers = make(map[string]*TransformPublisher)
+	}
+	t.publishers[path] = p
+	return p
 }
 
-// 为了验证测试，使用者自己加固，异常处理
-func (t *TransformTask) setupFfmpegTransformThrd1() {
-	TransformPlugin.Info("setupFfmpegTransformThrd1 url in and rtmp out...")
-	//转码并缩放
-	//成功
-	//ffmpeg -ss 0:01 -i "rtsp://127.0.0.1:554/njtv/glgc" -vcodec copy  -vcodec libx264 -s 720*576 -f flv "rtmp://127.0.0.1:1935/njtv/glgc-d1"
-
-	pullpath := "rtsp://127.0.0.1:554/" + t.streamConfig.StreamPath
-	tspath := "rtmp://127.0.0.1:1935/" + t.streamConfig.NewStreamPath
-
-	//转码并保存
-	//cmd := exec.Command("ffmpeg", "-re", "-r", "30", "-i", "pipe:0", "-vcodec", "libx264", "-f", "flv", "pipe:1", "-y", "another.flv")
-	cmd := exec.Command(conf.Ffmpeg, "-re",
-		"-i", pullpath,
-		//"-vcodec", "copy",
-		"-tune", "zerolatency", //编码延迟参数
-		"-vcodec", "libx264",
-		"-g", "12", "-keyint_min", "12", //设置GOP 大小和关键帧间隔
-		"-b:v", "400k",
-		"-preset", "superfast", //编码延迟参数，superfast ultrafast  影响图像质量
-		"-s", "320*240",
-		"-r", "25",
-		"-vf",
-		"drawtext=fontsize=100:fontfile=shoujin.ttf:text='m7s转码 ts0':x=500:y=500:fontcolor=green:box=1:boxcolor=yellow",
-		"-acodec", "libfaac",
-		"-b:a", "64k",
-		"-f",
-		"flv",
-		tspath,
-	)
+func (t *TransformTask) deletePublishers() {
+	t.mt.Lock()
+	publishers := t.publishers
+	t.publishers = nil
+	t.outputPaths = nil
+	t.mt.Unlock()
+	for _, p := range publishers {
+		TransformPlugin.Info("try to close TransformPublisher", zap.String("streamPath", p.path))
+		p.Delete()
+	}
+}
 
-	t.cmd = cmd
-	// Start the command
-	err := cmd.Start()
-	if err != nil {
-		fmt.Println("Error starting command:", err)
-		return
+// 第 index 路 ts 输出的发布者，发布者由 syncPublishers 在 ffmpeg 启动时创建，
+// 发布失败的地址到了退避时间才重新发布
+func (t *TransformTask) outputPublishers(index int) []*TransformPublisher {
+	t.mt.Lock()
+	var paths []string
+	if index < len(t.outputPaths) {
+		paths = t.outputPaths[index]
 	}
-	log.Printf("cmd Start  wait end....\n")
-	err = cmd.Wait()
-	if err != nil {
-		fmt.Println("Error Wait command:", err)
+	publishers := make([]*TransformPublisher, 0, len(paths))
+	var missing []string
+	now := time.Now()
+	for _, path := range paths {
+		if p := t.publishers[path]; p != nil {
+			publishers = append(publishers, p)
+		} else if retry := t.publishFail[path]; retry == nil || !now.Before(retry.retryAt) {
+			missing = append(missing, path)
+		}
 	}
-	log.Printf("ffmpegTransformThrd end\n")
+	t.mt.Unlock()
 
-	t.taskEnd("cmd end")
+	for _, path := range missing {
+		if p := t.publisher(path); p != nil {
+			publishers = append(publishers, p)
+		}
+	}
+	return publishers
 }
 
-// 为了验证测试，使用者自己加固，异常处理
-func (t *TransformTask) setupFfmpegTransformThrd2() {
-	TransformPlugin.Info("setupFfmpegTransformThrd2 pipe in and rtmp out...")
-	s := &TransformSubscriber{}
-	//s.IsInternal = true
-	s.task = t
-
-	t.s = s
-
-	// sub.onSubscriberSucess()
-	if err := TransformPlugin.Subscribe(t.streamConfig.StreamPath, s); err != nil {
-		TransformPlugin.Error("TransformPlugin 1 Subscribe faild")
-		t.taskEnd("Subscribe faild")
-		return
-	} else {
-		TransformPlugin.Info("TransformPlugin Subscribe sucess")
-		//重点需要goroutin
-		go s.PlayRaw()
-	}
-
-	cmd := exec.Command(conf.Ffmpeg, "-re",
-		"-i", "pipe:0",
-		"-tune", "zerolatency", //编码延迟参数
-		"-vcodec", "libx264",
-		"-g", "12", "-keyint_min", "12", //设置GOP 大小和关键帧间隔
-		"-b:v", "400k",
-		"-preset", "superfast", //编码延迟参数，superfast ultrafast  影响图像质量
-		"-s", "320*240",
-		"-r", "25",
-		"-vf",
-		"drawtext=fontsize=100:fontfile=shoujin.ttf:text='m7s转码 ts1':x=500:y=500:fontcolor=green:box=1:boxcolor=yellow",
-		"-acodec", "libfaac",
-		"-b:a", "64k",
-		"-f",
-		"flv",
-		"rtmp://127.0.0.1:1935/"+t.streamConfig.NewStreamPath,
-	)
-
-	t.cmd = cmd
-	//获取输入流
-	stdin, err := cmd.StdinPipe()
-	if err != nil {
-		fmt.Println("Error getting stdin pipe:", err)
-		return
+// ffmpeg 转码后的ts 流  发布 stream
+// 读到的数据复制给这一路输出的所有发布者，ffmpeg 退出后结束
+func (t *TransformTask) readFFPipe1AndToPublisher(index int, rp io.ReadCloser) {
+	defer rp.Close()
+	buf := make([]byte, 188*64)
+	for {
+		n, err := rp.Read(buf)
+		if n > 0 {
+			t.mt.Lock()
+			t.status = 2
+			t.out_bytes += n
+			t.mt.Unlock()
+			for _, p := range t.outputPublishers(index) {
+				p.pw.Write(buf[:n])
+			}
+		}
+		if err != nil {
+			TransformPlugin.Info("TransformTask TSPublisher no out rp valid exit thrd", zap.Error(err))
+			break
+		}
 	}
-	t.in_wp = stdin
+}
 
-	// Start the command
-	err = cmd.Start()
-	if err != nil {
-		fmt.Println("Error starting command:", err)
-		return
-	}
-	log.Printf("cmd Start  wait end....\n")
-	err = cmd.Wait()
-	if err != nil {
-		fmt.Println("Error Wait command:", err)
+// 发布者从管道读取 ts 流，管道关闭后结束
+func (p *TransformPublisher) feed(pr *io.PipeReader) {
+	for {
+		//很重要这一步
+		err := p.tsReader.Feed(p)
+		if errors.Is(err, io.ErrClosedPipe) || errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			TransformPlugin.Error("tsReader.Feed:", zap.Error(err))
+			//避免循环快速打印
+			time.Sleep(time.Duration(500) * time.Millisecond)
+		}
 	}
-	log.Printf("ffmpegTransformThrd end\n")
-
-	t.taskEnd("cmd end")
+	pr.Close()
 }
 
 func (t *TransformTask) taskEnd(reason string) {
+	t.mt.Lock()
+	if t.exit && t.exitReason != "" {
+		reason = t.exitReason
+	}
+	t.mt.Unlock()
 
-	tanfsTaskArray[t.streamConfig.NewStreamPath] = nil
-
-	if t.p != nil {
-		t.p.Stop()
-		t.p = nil
+	tanfsTaskLock.Lock()
+	for path, task := range tanfsTaskArray {
+		if task == t {
+			delete(tanfsTaskArray, path)
+		}
 	}
+	tanfsTaskLock.Unlock()
+
+	t.deletePublishers()
 	if t.s != nil {
-		t.s.Stop()
+		taskEngine.Unsubscribe(t.s, reason)
 		t.s = nil
 	}
+	t.stopExtraInputs()
+	t.removeTextFiles()
+	if t.ptz != nil {
+		t.ptz.close()
+	}
 
-	log.Printf(fmt.Sprintf("task:%s end for:%s\n", t.streamConfig.NewStreamPath, reason))
+	log.Printf("task:%s end for:%s\n", t.config().NewStreamPath, reason)
+	close(t.done)
 }
 
 func (t *TransformTask) debugPrintfNal(buf []byte, name string) {
@@ -719,7 +1311,7 @@ func (t *TransformTask) writeTmpFile(data []byte) {
 	if t.f == nil {
 		f, err := os.Create("tranform-tmp.ps")
 		if f == nil {
-			log.Println("create file faild:%v", err)
+			log.Printf("create file faild:%v", err)
 			return
 		}
 		t.f = f
@@ -727,7 +1319,7 @@ func (t *TransformTask) writeTmpFile(data []byte) {
 
 	_, err2 := t.f.Write(data)
 	if err2 != nil {
-		log.Println("Write file faild:%v", err2)
+		log.Printf("Write file faild:%v", err2)
 		return
 	}
 
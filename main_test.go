@@ -0,0 +1,400 @@
+package transform
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	. "m7s.live/engine/v4"
+)
+
+// 设置了这个环境变量时测试程序充当 ffmpeg，值为转码时的行为：
+//
+//	copy   标准输入原样写到标准输出，收到 SIGTERM 后写出一个 ts 空包再退出，模拟封装收尾
+//	stall  输出一次进度后不再读写，进程不退出，模拟卡死
+//	crash  原样输出第一次读到的数据后被信号结束，模拟崩溃
+//	exit   输出一次进度后以 1 退出，模拟拉流断开
+const fakeFfmpegEnv = "TRANSFORM_FAKE_FFMPEG"
+
+func TestMain(m *testing.M) {
+	if mode := os.Getenv(fakeFfmpegEnv); mode != "" {
+		os.Exit(fakeFfmpeg(mode, os.Args[1:]))
+	}
+	os.Exit(m.Run())
+}
+
+// 探测时输出的编码器和滤镜
+var fakeFilters = []string{"scale", "pad", "drawtext", "drawbox", "overlay", "crop", "zmq", "split", "null", "hflip", "vflip", "transpose"}
+
+// ts 空包，copy 模式结束时的收尾数据
+var tsNullPacket = append([]byte{0x47, 0x1f, 0xff, 0x10}, make([]byte, 184)...)
+
+func fakeFfmpeg(mode string, args []string) int {
+	switch {
+	case hasArg(args, "-version"):
+		fmt.Println("ffmpeg version 6.0-fake Copyright (c) 2000-2023 the FFmpeg developers")
+		return 0
+	case hasArg(args, "-encoders"):
+		fmt.Println("Encoders:\n V..... = Video\n ------")
+		fmt.Println(" V....D libx264              libx264 H.264 / AVC / MPEG-4 AVC (codec h264)")
+		fmt.Println(" A....D aac                  AAC (Advanced Audio Coding)")
+		return 0
+	case hasArg(args, "-filters"):
+		for _, name := range fakeFilters {
+			fmt.Printf(" ... %-16s V->V       fake\n", name)
+		}
+		return 0
+	}
+
+	fmt.Fprint(os.Stderr, "frame=1\nfps=25.0\nbitrate=400.0kbits/s\nout_time=00:00:00.040000\nspeed=1x\nprogress=continue\n")
+	if hasArg(args, "tee") {
+		fmt.Fprintln(os.Stderr, "[tee @ 0x1] Slave muxer #1 failed: Connection refused, continuing with 1/2 slaves.")
+	}
+	switch mode {
+	case "exit":
+		return 1
+	case "stall":
+		time.Sleep(time.Hour)
+		return 0
+	case "crash":
+		buf := make([]byte, 188*7)
+		n, _ := os.Stdin.Read(buf)
+		os.Stdout.Write(buf[:n])
+		self, _ := os.FindProcess(os.Getpid())
+		self.Kill()
+		time.Sleep(time.Hour)
+		return 0
+	}
+
+	term := make(chan os.Signal, 1)
+	signal.Notify(term, syscall.SIGTERM)
+	out := &lockedWriter{w: os.Stdout}
+	eof := make(chan struct{})
+	go func() {
+		io.Copy(out, os.Stdin)
+		close(eof)
+	}()
+	select {
+	case <-term:
+		out.Write(tsNullPacket)
+	case <-eof:
+	}
+	return 0
+}
+
+// 收尾数据和转发的数据不交错
+type lockedWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (l *lockedWriter) Write(b []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.w.Write(b)
+}
+
+func hasArg(args []string, arg string) bool {
+	for _, a := range args {
+		if a == arg {
+			return true
+		}
+	}
+	return false
+}
+
+// 以测试程序本身作为 ffmpeg
+func fakeFfmpegConfig(t *testing.T, mode string) *TransformConfig {
+	t.Setenv(fakeFfmpegEnv, mode)
+	//-race 编译的程序退出前默认等待 1 秒
+	t.Setenv("GORACE", "atexit_sleep_ms=0")
+	ffmpegCapsLock.Lock()
+	caps := ffmpegCaps
+	ffmpegCapsLock.Unlock()
+	t.Cleanup(func() {
+		ffmpegCapsLock.Lock()
+		ffmpegCaps = caps
+		ffmpegCapsLock.Unlock()
+	})
+	return &TransformConfig{Ffmpeg: os.Args[0], Path: t.TempDir(), Fontfile: "font.ttf"}
+}
+
+func waitFor(t *testing.T, what string, ok func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !ok() {
+		if time.Now().After(deadline) {
+			t.Fatal("timeout waiting for " + what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestProbeFakeFfmpeg(t *testing.T) {
+	conf := fakeFfmpegConfig(t, "copy")
+	caps := conf.probeFfmpeg()
+	if caps.Error != "" || caps.Version != "6.0-fake" || !caps.HasEncoder("libx264") || !caps.HasEncoder("aac") || len(caps.AudioEncoders) != 1 || !caps.HasFilter("drawtext") {
+		t.Errorf("probe = %+v", caps)
+	}
+}
+
+// 服务启动时探测 ffmpeg 并启动 onstart，拉流断开后按 reconnectdelay 重连，释放后清理文字文件
+func TestFirstConfigRestarts(t *testing.T) {
+	conf := fakeFfmpegConfig(t, "exit")
+	stream := pullConfig("test/firstconfig")
+	stream.HasOsd, stream.OsdLive, stream.OsdText = true, true, "live"
+	conf.OnStart = []StreamConfig{stream}
+	conf.OnEvent(FirstConfig{})
+
+	if caps := getFfmpegCapability(); caps == nil || !caps.HasEncoder("libx264") {
+		t.Fatalf("ffmpeg probe: %+v", caps)
+	}
+	tanfsTaskLock.RLock()
+	task := tanfsTaskArray["test/firstconfig"]
+	tanfsTaskLock.RUnlock()
+	if task == nil {
+		t.Fatal("onstart task not started")
+	}
+	waitFor(t, "pull reconnect", func() bool {
+		counts := task.counts()
+		return counts.restartFFCount >= 3 && counts.rePullCount >= 2
+	})
+	osdFile := conf.osdFile(&StreamConfig{textID: task.id})
+	if _, err := os.Stat(osdFile); err != nil {
+		t.Errorf("osd file not written: %v", err)
+	}
+
+	releaseTransform("test/firstconfig", "test")
+	waitDone(t, task)
+	if _, err := os.Stat(osdFile); !os.IsNotExist(err) {
+		t.Errorf("osd file not removed: %v", err)
+	}
+	if files, _ := filepath.Glob(filepath.Join(conf.textFileDir(), "transform-*")); len(files) > 0 {
+		t.Errorf("text files left: %v", files)
+	}
+}
+
+type nopWriteCloser struct{ io.Writer }
+
+func (nopWriteCloser) Close() error { return nil }
+
+func TestWriteToFFPipe0(t *testing.T) {
+	task := &TransformTask{}
+	task.writeToFFPipe0([]byte("lost"))
+	if counts := task.counts(); counts.status != 1 || counts.inBytes != 0 {
+		t.Errorf("without pipe: %+v", counts)
+	}
+
+	var buf bytes.Buffer
+	task.in_wp = nopWriteCloser{&buf}
+	done := make(chan struct{})
+	//订阅线程写入时任务线程同时读状态
+	go func() {
+		for i := 0; i < 100; i++ {
+			task.writeToFFPipe0([]byte("ab"))
+		}
+		close(done)
+	}()
+	for i := 0; i < 100; i++ {
+		task.Status()
+	}
+	<-done
+	if counts := task.counts(); counts.inBytes != 200 || buf.Len() != 200 {
+		t.Errorf("inBytes = %d written = %d, want 200", counts.inBytes, buf.Len())
+	}
+}
+
+// 一路输出复制给这一路的所有发布者
+func TestReadFFPipe1AndToPublisher(t *testing.T) {
+	task := &TransformTask{publishers: make(map[string]*TransformPublisher)}
+	var readers []*io.PipeReader
+	var paths []string
+	for _, path := range []string{"test/a", "test/b"} {
+		pr, pw := io.Pipe()
+		task.publishers[path] = &TransformPublisher{task: task, pw: pw}
+		readers = append(readers, pr)
+		paths = append(paths, path)
+	}
+	task.outputPaths = [][]string{paths}
+
+	data := strings.Repeat("ts", 188*64)
+	received := make([]chan string, len(readers))
+	for i, pr := range readers {
+		received[i] = make(chan string, 1)
+		go func(pr *io.PipeReader, ch chan string) {
+			b, _ := io.ReadAll(pr)
+			ch <- string(b)
+		}(pr, received[i])
+	}
+	task.readFFPipe1AndToPublisher(0, io.NopCloser(strings.NewReader(data)))
+	for _, p := range task.publishers {
+		p.pw.Close()
+	}
+	for i, ch := range received {
+		if got := <-ch; got != data {
+			t.Errorf("publisher %d received %d bytes, want %d", i, len(got), len(data))
+		}
+	}
+	if counts := task.counts(); counts.status != 2 || counts.outBytes != len(data) {
+		t.Errorf("counts = %+v", counts)
+	}
+}
+
+// 注册表中 path 对应的任务
+func registeredTask(path string) *TransformTask {
+	tanfsTaskLock.RLock()
+	defer tanfsTaskLock.RUnlock()
+	return tanfsTaskArray[path]
+}
+
+// 合成的 H.264 经订阅者写入假 ffmpeg，原样输出后到达发布者；原地重启保留订阅者和发布者并补发 SPS PPS，
+// 共用任务的调用者逐个释放时注册表和发布者保持一致，最后一个释放后全部清理
+func TestSyntheticH264Pipeline(t *testing.T) {
+	conf := fakeFfmpegConfig(t, "copy")
+	engine := useFakeEngine(t)
+	config := StreamConfig{StreamPath: "live/h264", NewStreamPath: "test/h264"}
+	if err := conf.SetUpTransformTask(config); err != nil {
+		t.Fatal(err)
+	}
+	task := registeredTask("test/h264")
+	if task == nil {
+		t.Fatal("task not registered")
+	}
+	sps, pps := annexB(syntheticSPS), annexB(syntheticPPS)
+	waitFor(t, "sps pps and frames published", func() bool {
+		data := engine.received("test/h264")
+		return bytes.HasPrefix(data, append(sps, pps...)) && bytes.Contains(data, syntheticIDR)
+	})
+	task.mt.Lock()
+	source := task.source
+	task.mt.Unlock()
+	if source.Width != 1280 || source.Height != 720 {
+		t.Errorf("source = %+v", source)
+	}
+
+	task.restartFF("test")
+	waitFor(t, "sps pps resent after restart", func() bool {
+		return bytes.Count(engine.received("test/h264"), sps) == 2
+	})
+	if !bytes.Contains(engine.received("test/h264"), tsNullPacket) {
+		t.Error("trailer written on SIGTERM not published")
+	}
+	counts := task.counts()
+	if counts.restartFFCount != 2 || counts.inBytes == 0 || counts.outBytes == 0 {
+		t.Errorf("counts = %+v", counts)
+	}
+	if subscribes, playing := engine.counts(); subscribes != 1 || playing != 1 || engine.publishCount("test/h264") != 1 {
+		t.Errorf("restart in place resubscribed or republished: %d subscribes %d playing %d publishes", subscribes, playing, engine.publishCount("test/h264"))
+	}
+
+	config.NewStreamPath = "test/h264-b"
+	if err := conf.SetUpTransformTask(config); err != nil {
+		t.Fatal(err)
+	}
+	if registeredTask("test/h264-b") != task {
+		t.Fatal("identical request not shared")
+	}
+	waitFor(t, "shared caller published", func() bool { return bytes.Contains(engine.received("test/h264-b"), syntheticIDR) })
+
+	releaseTransform("test/h264", "test")
+	if registeredTask("test/h264") != nil || registeredTask("test/h264-b") != task || engine.live("test/h264") || !engine.live("test/h264-b") {
+		t.Error("registry or publishers inconsistent after releasing one caller")
+	}
+	if task.exiting() {
+		t.Error("task stopped while a caller remains")
+	}
+
+	releaseTransform("test/h264-b", "test")
+	waitDone(t, task)
+	if registeredTask("test/h264-b") != nil || engine.live("test/h264-b") {
+		t.Error("registry or publishers left after stop")
+	}
+	waitFor(t, "publisher pipe closed", func() bool { return engine.closed("test/h264") })
+	waitFor(t, "publisher b pipe closed", func() bool { return engine.closed("test/h264-b") })
+	if _, playing := engine.counts(); playing != 0 {
+		t.Error("subscriber not stopped")
+	}
+	task.mt.Lock()
+	defer task.mt.Unlock()
+	if len(task.publishers) != 0 || task.transcoder != nil || task.in_wp != nil {
+		t.Errorf("task not cleaned up: %d publishers", len(task.publishers))
+	}
+}
+
+// ffmpeg 卡死时源还在送数据，进度停止超过 stalltimeout 后原地重启，不重新订阅和发布
+func TestStalledFfmpegRestarts(t *testing.T) {
+	conf := fakeFfmpegConfig(t, "stall")
+	conf.StallTimeout = 200 * time.Millisecond
+	engine := useFakeEngine(t)
+	if err := conf.SetUpTransformTask(StreamConfig{StreamPath: "live/stall", NewStreamPath: "test/stall"}); err != nil {
+		t.Fatal(err)
+	}
+	task := registeredTask("test/stall")
+	if task == nil {
+		t.Fatal("task not registered")
+	}
+	waitFor(t, "stalled ffmpeg restarted", func() bool { return task.counts().restartFFCount >= 3 })
+	if subscribes, playing := engine.counts(); subscribes != 1 || playing != 1 || engine.publishCount("test/stall") != 1 {
+		t.Errorf("stall restart resubscribed or republished: %d subscribes %d playing %d publishes", subscribes, playing, engine.publishCount("test/stall"))
+	}
+	if len(engine.received("test/stall")) != 0 {
+		t.Error("stalled ffmpeg published data")
+	}
+
+	releaseTransform("test/stall", "test")
+	waitDone(t, task)
+	if _, playing := engine.counts(); playing != 0 || engine.live("test/stall") {
+		t.Error("subscriber or publisher left after stop")
+	}
+}
+
+// 源断流时进度也会停止，不当作卡死
+func TestStallWatchIgnoresIdleSource(t *testing.T) {
+	f := &fakeTranscoder{progress: TranscodeProgress{Frame: 1, Time: time.Now()}}
+	task := &TransformTask{plugin: &TransformConfig{StallTimeout: 40 * time.Millisecond}}
+	done := make(chan struct{})
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		close(done)
+	}()
+	task.watchStall(f, true, done)
+	if task.counts().restartFFCount != 0 || task.keepStreams {
+		t.Error("restarted while the source was idle")
+	}
+}
+
+// ffmpeg 崩溃后关闭订阅和发布，等待后重新订阅、发布，任务保留在注册表中
+func TestCrashedFfmpegRestarts(t *testing.T) {
+	conf := fakeFfmpegConfig(t, "crash")
+	engine := useFakeEngine(t)
+	if err := conf.SetUpTransformTask(StreamConfig{StreamPath: "live/crash", NewStreamPath: "test/crash"}); err != nil {
+		t.Fatal(err)
+	}
+	task := registeredTask("test/crash")
+	if task == nil {
+		t.Fatal("task not registered")
+	}
+	waitFor(t, "crashed ffmpeg restarted", func() bool {
+		return task.counts().restartFFCount >= 2 && engine.publishCount("test/crash") >= 2
+	})
+	if registeredTask("test/crash") != task {
+		t.Error("task removed from registry after crash")
+	}
+	if subscribes, _ := engine.counts(); subscribes < 2 {
+		t.Errorf("%d subscribes after crash, want a new subscriber", subscribes)
+	}
+
+	releaseTransform("test/crash", "test")
+	waitDone(t, task)
+	if _, playing := engine.counts(); playing != 0 || engine.live("test/crash") || registeredTask("test/crash") != nil {
+		t.Error("task not cleaned up after stop")
+	}
+}
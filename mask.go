@@ -0,0 +1,196 @@
+package transform
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// 隐私遮挡区域，矩形或多边形，在源画面上处理，先于缩放和叠加
+type Mask struct {
+	Mode       string      `yaml:"mode"` //fill（默认） blur pixelate
+	X          float64     `yaml:"x"`
+	Y          float64     `yaml:"y"`
+	W          float64     `yaml:"w"`
+	H          float64     `yaml:"h"`
+	Points     [][]float64 `yaml:"points"`     //多边形顶点 [[x,y],...]，有值时忽略矩形
+	Normalized bool        `yaml:"normalized"` //坐标为相对画面宽高的比例 0~1，否则为像素
+	Color      string      `yaml:"color"`      //fill 的颜色，默认 black
+	Strength   int         `yaml:"strength"`   //blur 的半径，默认 10；pixelate 的像素块大小，默认 16
+}
+
+// [{"mode":"blur","x":0.1,"y":0.1,"w":0.2,"h":0.2,"normalized":true}]
+func parseMasks(s string) ([]Mask, error) {
+	var masks []Mask
+	if err := json.Unmarshal([]byte(s), &masks); err != nil {
+		return nil, fmt.Errorf("invalid masks: %w", err)
+	}
+	return masks, nil
+}
+
+func validateMask(mask *Mask) error {
+	switch mask.Mode {
+	case "", "fill", "blur", "pixelate":
+	default:
+		return fmt.Errorf("invalid mask mode: %s", mask.Mode)
+	}
+	if mask.Strength < 0 {
+		return errors.New("mask strength must not be negative")
+	}
+	coords := []float64{mask.X, mask.Y, mask.W, mask.H}
+	if len(mask.Points) > 0 {
+		if len(mask.Points) < 3 {
+			return errors.New("mask polygon needs at least 3 points")
+		}
+		coords = nil
+		for _, p := range mask.Points {
+			if len(p) != 2 {
+				return errors.New("mask point must be [x,y]")
+			}
+			coords = append(coords, p...)
+		}
+	} else if mask.W <= 0 || mask.H <= 0 {
+		return errors.New("mask width and height must be positive")
+	}
+	for _, v := range coords {
+		if v < 0 || mask.Normalized && v > 1 {
+			return fmt.Errorf("invalid mask coordinate: %g", v)
+		}
+	}
+	return nil
+}
+
+// 坐标表达式，比例坐标乘以 size（iw W 等）
+func (m *Mask) coord(v float64, size string) string {
+	s := strconv.FormatFloat(v, 'f', -1, 64)
+	if m.Normalized {
+		return size + "*" + s
+	}
+	return s
+}
+
+func (m *Mask) strength(def int) int {
+	if m.Strength > 0 {
+		return m.Strength
+	}
+	return def
+}
+
+// 模糊或马赛克处理整个输入画面
+func (m *Mask) effectFilters(g *filterGraph) []string {
+	if m.Mode == "pixelate" {
+		n := m.strength(16)
+		//向上取整，放大后不会比原区域小
+		return []string{
+			g.F("scale", "w="+filterValue(fmt.Sprintf("ceil(iw/%d)", n)), "h="+filterValue(fmt.Sprintf("ceil(ih/%d)", n))),
+			g.F("scale", fmt.Sprintf("w=iw*%d", n), fmt.Sprintf("h=ih*%d", n), "flags=neighbor"),
+		}
+	}
+	//半径不能超过色度平面短边的一半
+	return []string{g.F("boxblur", "luma_radius="+filterValue(fmt.Sprintf("min(%d,min(w,h)/4)", m.strength(10))))}
+}
+
+// 多边形内部判断，射线法统计与水平射线相交的边数，奇数在内部
+func (m *Mask) insideExpr() string {
+	var terms []string
+	n := len(m.Points)
+	for i := 0; i < n; i++ {
+		xi, yi := m.coord(m.Points[i][0], "W"), m.coord(m.Points[i][1], "H")
+		xj, yj := m.coord(m.Points[(i+1)%n][0], "W"), m.coord(m.Points[(i+1)%n][1], "H")
+		//水平边不会与水平射线相交
+		if m.Points[i][1] == m.Points[(i+1)%n][1] {
+			continue
+		}
+		terms = append(terms, fmt.Sprintf("not(eq(gt(%[2]s,Y),gt(%[4]s,Y)))*lt(X,(%[3]s-%[1]s)*(Y-(%[2]s))/((%[4]s)-(%[2]s))+%[1]s)",
+			xi, yi, xj, yj))
+	}
+	return "255*mod(" + strings.Join(terms, "+") + ",2)"
+}
+
+// 依次处理遮挡区域
+func maskFilter(g *filterGraph, config *StreamConfig) {
+	for i := range config.Masks {
+		m := &config.Masks[i]
+		color := m.Color
+		if color == "" {
+			color = "black"
+		}
+
+		//矩形填充直接用 drawbox
+		if len(m.Points) == 0 && m.Mode != "blur" && m.Mode != "pixelate" {
+			g.Filter("drawbox", "x="+filterValue(m.coord(m.X, "iw")), "y="+filterValue(m.coord(m.Y, "ih")),
+				"w="+filterValue(m.coord(m.W, "iw")), "h="+filterValue(m.coord(m.H, "ih")),
+				"color="+filterValue(color), "t=fill")
+			continue
+		}
+
+		//复制一路处理后叠加回去
+		splits := g.Split(2)
+		masked := g.Label("mask")
+		out := g.Label("v")
+		if len(m.Points) == 0 {
+			filters := []string{g.F("crop", "w="+filterValue(m.coord(m.W, "iw")), "h="+filterValue(m.coord(m.H, "ih")),
+				"x="+filterValue(m.coord(m.X, "iw")), "y="+filterValue(m.coord(m.Y, "ih")))}
+			g.Chain(splits[1:], []string{masked}, append(filters, m.effectFilters(g)...)...)
+			g.Chain([]string{splits[0], masked}, []string{out}, g.F("overlay",
+				"x="+filterValue(m.coord(m.X, "W")), "y="+filterValue(m.coord(m.Y, "H"))))
+		} else {
+			var filters []string
+			if m.Mode == "blur" || m.Mode == "pixelate" {
+				filters = m.effectFilters(g)
+			} else {
+				filters = []string{g.F("drawbox", "x=0", "y=0", "w=iw", "h=ih", "color="+filterValue(color), "t=fill")}
+			}
+			//多边形不随画面变化，只对第一帧用 geq 画出 alpha（多边形外为 0），之后 alphamerge 重复使用这一帧
+			effected := []string{g.Label("fx"), g.Label("fx")}
+			alpha := g.Label("alpha")
+			g.Chain(splits[1:], effected, append(filters, g.F("split"))...)
+			g.Chain(effected[1:], []string{alpha}, g.F("trim", "end_frame=1"), g.F("format", "gray"),
+				g.F("geq", "lum="+filterValue(m.insideExpr())))
+			g.Chain([]string{effected[0], alpha}, []string{masked}, g.F("alphamerge"))
+			g.Chain([]string{splits[0], masked}, []string{out}, g.F("overlay", "x=0", "y=0"))
+		}
+		g.Continue(out)
+	}
+}
+
+// /transform/masks?newstreampath=xxx
+// GET 返回任务的遮挡区域，POST/PUT 以 json 数组替换遮挡区域并原地重启 ffmpeg
+func (t *TransformConfig) Masks(w http.ResponseWriter, r *http.Request) {
+	task, newStreamPath := lookupTask(w, r)
+	if task == nil {
+		return
+	}
+
+	config := task.callerConfig(newStreamPath)
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost, http.MethodPut:
+		if !taskOwned(w, task) {
+			return
+		}
+		body, err := io.ReadAll(r.Body)
+		if err == nil {
+			config.Masks, err = parseMasks(string(body))
+		}
+		//与其他修改一样检查编码器、滤镜和转码引擎是否支持
+		if err == nil {
+			err = t.resolveStreamConfig(&config)
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		task.update(config)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(config.Masks)
+}
@@ -0,0 +1,20 @@
+package transform
+
+import (
+	"strings"
+	"testing"
+)
+
+// 多边形的 alpha 只在第一帧计算，不对每帧逐像素求值
+func TestPolygonMaskFilter(t *testing.T) {
+	for _, mode := range []string{"fill", "blur", "pixelate"} {
+		config := StreamConfig{Masks: []Mask{{Mode: mode, Points: [][]float64{{0.1, 0.1}, {0.5, 0.1}, {0.3, 0.6}}, Normalized: true}}}
+		g := newFilterGraph("0:v")
+		maskFilter(g, &config)
+		g.Output("out")
+		graph := g.String()
+		if strings.Count(graph, "geq=") != 1 || !strings.Contains(graph, "trim=end_frame=1,format=gray,geq=") || !strings.Contains(graph, "alphamerge") {
+			t.Errorf("%s: %s", mode, graph)
+		}
+	}
+}
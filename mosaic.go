@@ -0,0 +1,316 @@
+package transform
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// 画面拼接：多路订阅流按网格缩放到各格，没有画面的格子显示占位画面，没有主输入
+type MosaicConfig struct {
+	Layout        string       `yaml:"layout" json:"layout"`               //列x行 eg:2x2 3x3 4x3，为空时按格子数取方阵
+	Tiles         []MosaicTile `yaml:"tiles" json:"tiles"`                 //各格，按顺序从左到右、从上到下排列
+	Gap           int          `yaml:"gap" json:"gap"`                     //格子间距，像素
+	Placeholder   string       `yaml:"placeholder" json:"placeholder"`     //占位画面上的文字，默认 NO SIGNAL
+	LabelFontsize int          `yaml:"labelfontsize" json:"labelfontsize"` //标签字号，默认格高的 1/12
+}
+
+type MosaicTile struct {
+	StreamPath string `yaml:"streampath" json:"streampath"` //为空时一直显示占位画面
+	Label      string `yaml:"label" json:"label"`           //左下角的标签
+	Cell       []int  `yaml:"cell" json:"cell"`             //[列, 行] 或 [列, 行, 跨列, 跨行]，省略时按顺序占一格
+}
+
+var layoutRegexp = regexp.MustCompile(`^(\d+)x(\d+)$`)
+
+// {"layout":"2x2","tiles":[{"streampath":"live/cam1","label":"大门"},{"streampath":"live/cam2"}]}
+func parseMosaic(s string) (*MosaicConfig, error) {
+	var mosaic MosaicConfig
+	if err := json.Unmarshal([]byte(s), &mosaic); err != nil {
+		return nil, fmt.Errorf("invalid mosaic: %w", err)
+	}
+	return &mosaic, nil
+}
+
+func defaultMosaicConfig(config *StreamConfig) {
+	mosaic := config.Mosaic
+	if config.TransType != TransTypeMosaic || mosaic == nil {
+		return
+	}
+	if mosaic.Layout == "" && len(mosaic.Tiles) > 0 {
+		n := int(math.Ceil(math.Sqrt(float64(len(mosaic.Tiles)))))
+		mosaic.Layout = fmt.Sprintf("%dx%d", n, n)
+	}
+	if mosaic.Placeholder == "" {
+		mosaic.Placeholder = "NO SIGNAL"
+	}
+}
+
+func parseLayout(layout string) (cols, rows int, err error) {
+	m := layoutRegexp.FindStringSubmatch(layout)
+	if m == nil {
+		return 0, 0, fmt.Errorf("invalid mosaic layout: %s", layout)
+	}
+	cols, _ = strconv.Atoi(m[1])
+	rows, _ = strconv.Atoi(m[2])
+	if cols < 1 || rows < 1 || cols > 8 || rows > 8 {
+		return 0, 0, fmt.Errorf("invalid mosaic layout: %s", layout)
+	}
+	return
+}
+
+// 第 i 格占的网格位置，省略 cell 时按顺序排列
+func (m *MosaicConfig) cell(i, cols int) (col, row, colSpan, rowSpan int) {
+	c := m.Tiles[i].Cell
+	switch len(c) {
+	case 2:
+		return c[0], c[1], 1, 1
+	case 4:
+		return c[0], c[1], c[2], c[3]
+	}
+	return i % cols, i / cols, 1, 1
+}
+
+func validateMosaic(config *StreamConfig) error {
+	if config.TransType != TransTypeMosaic {
+		if config.Mosaic != nil {
+			return errors.New("mosaic requires transtype 6")
+		}
+		return nil
+	}
+	//各格的流从 fd 3 起的管道输入
+	if err := checkExtraPipes(config); err != nil {
+		return err
+	}
+	mosaic := config.Mosaic
+	if mosaic == nil || len(mosaic.Tiles) == 0 {
+		return errors.New("mosaic tiles is empty")
+	}
+	//格子尺寸由输出尺寸计算
+	res, _ := parseResolution(config.Resolution)
+	if !res.boxed() || res.Max {
+		return errors.New("mosaic requires a w*h resolution")
+	}
+	cols, rows, err := parseLayout(mosaic.Layout)
+	if err != nil {
+		return err
+	}
+	if mosaic.Gap < 0 || mosaic.LabelFontsize < 0 {
+		return errors.New("mosaic gap and labelfontsize must not be negative")
+	}
+	for i, tile := range mosaic.Tiles {
+		if len(tile.Cell) != 0 && len(tile.Cell) != 2 && len(tile.Cell) != 4 {
+			return fmt.Errorf("invalid mosaic tile %d cell: %v", i, tile.Cell)
+		}
+		col, row, colSpan, rowSpan := mosaic.cell(i, cols)
+		if col < 0 || row < 0 || colSpan < 1 || rowSpan < 1 || col+colSpan > cols || row+rowSpan > rows {
+			return fmt.Errorf("mosaic tile %d is outside layout %s", i, mosaic.Layout)
+		}
+	}
+	if w, h := mosaicCellSize(config, cols, rows); w < 16 || h < 16 {
+		return fmt.Errorf("mosaic tiles are too small: %dx%d", w, h)
+	}
+	return nil
+}
+
+// 一个网格单元的尺寸，取偶数
+func mosaicCellSize(config *StreamConfig, cols, rows int) (w, h int) {
+	res, _ := parseResolution(config.Resolution)
+	gap := config.Mosaic.Gap
+	w = (res.W - gap*(cols+1)) / cols / 2 * 2
+	h = (res.H - gap*(rows+1)) / rows / 2 * 2
+	return
+}
+
+// 第 i 格在输出画面中的位置和尺寸
+func mosaicTileRect(config *StreamConfig, i int) (x, y, w, h int) {
+	mosaic := config.Mosaic
+	cols, rows, _ := parseLayout(mosaic.Layout)
+	cellW, cellH := mosaicCellSize(config, cols, rows)
+	col, row, colSpan, rowSpan := mosaic.cell(i, cols)
+	gap := mosaic.Gap
+	x = gap + col*(cellW+gap)
+	y = gap + row*(cellH+gap)
+	w = colSpan*cellW + (colSpan-1)*gap
+	h = rowSpan*cellH + (rowSpan-1)*gap
+	return
+}
+
+// 黑色底图上依次叠加各格，同一路源在多个格子中时先 split
+func (t *TransformConfig) mosaicFilter(g *filterGraph, config *StreamConfig) {
+	mosaic := config.Mosaic
+
+	//每路有画面的源被几个格子使用
+	uses := make(map[string]int)
+	for _, tile := range mosaic.Tiles {
+		if _, ok := extraInputIndex(config, tile.StreamPath); ok {
+			uses[tile.StreamPath]++
+		}
+	}
+	pads := make(map[string][]string)
+	for _, path := range liveSources(config) {
+		n := uses[path]
+		if n == 0 {
+			continue
+		}
+		index, _ := extraInputIndex(config, path)
+		in := fmt.Sprintf("%d:v", index)
+		if n == 1 {
+			pads[path] = []string{in}
+			continue
+		}
+		outs := make([]string, n)
+		for i := range outs {
+			outs[i] = g.Label("s")
+		}
+		g.Chain([]string{in}, outs, g.F("split", strconv.Itoa(n)))
+		pads[path] = outs
+	}
+
+	for i, tile := range mosaic.Tiles {
+		x, y, w, h := mosaicTileRect(config, i)
+		fontsize := mosaic.LabelFontsize
+		if fontsize == 0 {
+			fontsize = h / 12
+		}
+		var filters []string
+		var ins []string
+		if p := pads[tile.StreamPath]; len(p) > 0 {
+			ins = []string{p[0]}
+			pads[tile.StreamPath] = p[1:]
+			filters = fitFilters(g, w, h)
+		} else {
+			filters = t.placeholderFilters(g, config, mosaic.Placeholder, w, h)
+		}
+		if tile.Label != "" {
+			filters = append(filters, g.F("drawtext", drawtextRawArgs(t.Fontfile, fontsize, drawtextText(ffEscape(tile.Label, "%")),
+				"8", "h-text_h-8", "white", "black@0.5")...))
+		}
+		tilePad := g.Label("tile")
+		g.Chain(ins, []string{tilePad}, filters...)
+
+		main := g.Pad()
+		out := g.Label("v")
+		g.Chain([]string{main, tilePad}, []string{out}, g.F("overlay", fmt.Sprintf("x=%d", x), fmt.Sprintf("y=%d", y), "eof_action=pass"))
+		g.Continue(out)
+	}
+}
+
+// 各路源从附加管道输入，拼接后 ts 流从管道输出
+func (t *TransformConfig) ffmpegCommand6(config *StreamConfig) *ffmpegCommand {
+	res, _ := parseResolution(config.Resolution)
+	g := newFilterGraph("")
+	//没有源有画面时只有 color 源，realtime 限制为实时速度
+	bg := g.Label("bg")
+	g.Chain(nil, []string{bg},
+		g.F("color", "c=black", fmt.Sprintf("s=%dx%d", res.W, res.H), "r="+config.Fps),
+		g.F("realtime"),
+	)
+	g.Continue(bg)
+	t.mosaicFilter(g, config)
+	t.osdFilter(g, config)
+	g.Append(t.textFilters(g, config)...)
+	g.Append(t.tickerFilters(g, config)...)
+	t.logoFilter(g, config)
+	g.Output("vout")
+
+	outArgs, pipeOuts := outputArgs(config)
+	extraArgs, extraIns := extraInputArgs(config, pipeOuts)
+	args := append(globalArgs(), extraArgs...)
+	args = append(args, "-filter_complex", g.String(), "-map", "[vout]")
+	args = append(args, videoEncodeArgs(config)...)
+	args = append(args, outArgs...)
+	return &ffmpegCommand{Args: args, Filter: g, FilterOutputs: []string{"vout"}, PipeOuts: pipeOuts, ExtraIns: extraIns}
+}
+
+// 各格状态
+type MosaicTileStatus struct {
+	MosaicTile
+	Live bool `json:"live"`
+}
+
+type MosaicResult struct {
+	Layout string             `json:"layout"`
+	Tiles  []MosaicTileStatus `json:"tiles"`
+}
+
+// /transform/mosaic?newstreampath=xxx 返回各格及是否有画面
+// /transform/mosaic?newstreampath=xxx&swap=0,3 交换两格的源和标签
+// /transform/mosaic?newstreampath=xxx&tile=2&streampath=live/cam9&label=后门 修改一格的源和标签
+func (t *TransformConfig) Mosaic(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	task, newStreamPath := lookupTask(w, r)
+	if task == nil {
+		return
+	}
+	config := task.callerConfig(newStreamPath)
+	if config.Mosaic == nil {
+		http.Error(w, "task is not mosaic", http.StatusBadRequest)
+		return
+	}
+
+	if query.Has("swap") || query.Has("tile") {
+		//共用的任务修改画面会影响其他调用者
+		if !taskOwned(w, task) {
+			return
+		}
+		mosaic := *config.Mosaic
+		mosaic.Tiles = append([]MosaicTile(nil), mosaic.Tiles...)
+		index := func(s string) (int, error) {
+			i, err := strconv.Atoi(s)
+			if err != nil || i < 0 || i >= len(mosaic.Tiles) {
+				return 0, fmt.Errorf("invalid tile: %s", s)
+			}
+			return i, nil
+		}
+		var err error
+		if query.Has("swap") {
+			a, b, _ := strings.Cut(query.Get("swap"), ",")
+			var i, j int
+			if i, err = index(a); err == nil {
+				j, err = index(b)
+			}
+			if err == nil {
+				//位置不变，只交换内容
+				ti, tj := mosaic.Tiles[i], mosaic.Tiles[j]
+				ti.StreamPath, tj.StreamPath = tj.StreamPath, ti.StreamPath
+				ti.Label, tj.Label = tj.Label, ti.Label
+				mosaic.Tiles[i], mosaic.Tiles[j] = ti, tj
+			}
+		} else {
+			var i int
+			if i, err = index(query.Get("tile")); err == nil {
+				if query.Has("streampath") {
+					mosaic.Tiles[i].StreamPath = query.Get("streampath")
+				}
+				if query.Has("label") {
+					mosaic.Tiles[i].Label = query.Get("label")
+				}
+			}
+		}
+		config.Mosaic = &mosaic
+		if err == nil {
+			err = t.resolveStreamConfig(&config)
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		task.update(config)
+	}
+
+	task.mt.Lock()
+	live := task.inputsLive()
+	task.mt.Unlock()
+	result := MosaicResult{Layout: config.Mosaic.Layout}
+	for _, tile := range config.Mosaic.Tiles {
+		result.Tiles = append(result.Tiles, MosaicTileStatus{MosaicTile: tile, Live: live[tile.StreamPath]})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
@@ -0,0 +1,74 @@
+package transform
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+)
+
+// 裁剪区域 w*h+x+y，省略 +x+y 时居中裁剪
+var cropRegexp = regexp.MustCompile(`^(\d+)[*x](\d+)(?:\+(\d+)\+(\d+))?$`)
+
+func validateOrient(config *StreamConfig) error {
+	if config.Crop != "" {
+		m := cropRegexp.FindStringSubmatch(config.Crop)
+		if m == nil || m[1] == "0" || m[2] == "0" {
+			return fmt.Errorf("invalid crop: %s", config.Crop)
+		}
+	}
+	switch config.Rotate {
+	case 0, 90, 180, 270:
+	default:
+		return fmt.Errorf("invalid rotate: %d", config.Rotate)
+	}
+	return nil
+}
+
+// 裁剪、旋转、翻转，在遮挡、osd 和缩放之前，之后的坐标都基于摆正后的画面
+func orientFilter(g *filterGraph, config *StreamConfig) {
+	if m := cropRegexp.FindStringSubmatch(config.Crop); m != nil {
+		args := []string{"w=" + m[1], "h=" + m[2]}
+		if m[3] != "" {
+			args = append(args, "x="+m[3], "y="+m[4])
+		}
+		g.Filter("crop", args...)
+	}
+	switch config.Rotate {
+	case 90:
+		g.Filter("transpose", "dir=clock")
+	case 180:
+		g.Filter("hflip").Filter("vflip")
+	case 270:
+		g.Filter("transpose", "dir=cclock")
+	}
+	if config.HFlip {
+		g.Filter("hflip")
+	}
+	if config.VFlip {
+		g.Filter("vflip")
+	}
+}
+
+// 裁剪、旋转后的画面尺寸，源尺寸未知时为零值
+func orientedSize(config *StreamConfig, source SourceInfo) SourceInfo {
+	if source.Width == 0 {
+		return source
+	}
+	if m := cropRegexp.FindStringSubmatch(config.Crop); m != nil {
+		source.Width, _ = strconv.Atoi(m[1])
+		source.Height, _ = strconv.Atoi(m[2])
+	}
+	if config.Rotate == 90 || config.Rotate == 270 {
+		source.Width, source.Height = source.Height, source.Width
+	}
+	return source
+}
+
+// 0 1 true false 都可以
+func parseBool(key, value string) (bool, error) {
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, fmt.Errorf("invalid %s: %s", key, value)
+	}
+	return b, nil
+}
@@ -0,0 +1,147 @@
+package transform
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"go.uber.org/zap"
+)
+
+// 实时 osd 和滚动字幕：drawtext 以 reload=1 每帧读取文字文件，改写文件即可更新文字，不需要重启 ffmpeg
+
+// 实时文字文件所在目录，未配置 path 时使用系统临时目录
+func (t *TransformConfig) textFileDir() string {
+	if t.Path != "" {
+		return t.Path
+	}
+	return os.TempDir()
+}
+
+// 实时文字文件，以任务编号命名，每个任务一个，
+// 共用的任务是同一个任务，改文字后重启 ffmpeg 仍然读同一个文件
+func (t *TransformConfig) textFile(config *StreamConfig, kind string) string {
+	return filepath.Join(t.textFileDir(), fmt.Sprintf("transform-%s-%s.txt", kind, config.textID))
+}
+
+func (t *TransformConfig) osdFile(config *StreamConfig) string {
+	return t.textFile(config, "osd")
+}
+
+func (t *TransformConfig) tickerFile(config *StreamConfig) string {
+	return t.textFile(config, "ticker")
+}
+
+// 先写临时文件再改名，drawtext 不会读到写了一半的内容
+func writeTextFile(path string, text string) error {
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	//drawtext 会展开文件中的 %{} 和反斜杠
+	_, err = f.WriteString(ffEscape(text, "%"))
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
+
+// 带任务编号的配置，用于定位实时文字文件
+func (t *TransformTask) textConfig() StreamConfig {
+	config := t.config()
+	config.textID = t.id
+	return config
+}
+
+// 配置用到的实时文字文件及其初始文字
+func (t *TransformConfig) textFiles(config *StreamConfig) map[string]string {
+	files := make(map[string]string)
+	if config.OsdLive {
+		files[t.osdFile(config)] = config.OsdText
+	}
+	if config.Ticker != nil {
+		files[t.tickerFile(config)] = config.Ticker.Text
+	}
+	return files
+}
+
+// ffmpeg 启动前写好实时文字文件
+func (t *TransformTask) writeTextFiles(config *StreamConfig) {
+	for path, text := range t.plugin.textFiles(config) {
+		if err := writeTextFile(path, text); err != nil {
+			TransformPlugin.Error("write text file", zap.String("path", path), zap.Error(err))
+		}
+	}
+}
+
+// 任务结束后删除实时文字文件
+func (t *TransformTask) removeTextFiles() {
+	config := t.textConfig()
+	for path := range t.plugin.textFiles(&config) {
+		os.Remove(path)
+	}
+}
+
+// /transform/osd?newstreampath=xxx&text=xxx
+// 修改 osd 文字，osdlive 的任务只改写文字文件，其余任务原地重启 ffmpeg
+func (t *TransformConfig) Osd(w http.ResponseWriter, r *http.Request) {
+	task, _ := lookupOwnedTask(w, r)
+	if task == nil {
+		return
+	}
+
+	text := r.URL.Query().Get("text")
+	task.mt.Lock()
+	task.streamConfig.OsdText = text
+	task.streamConfig.HasOsd = true
+	config := task.streamConfig
+	config.textID = task.id
+	task.mt.Unlock()
+
+	if !config.OsdLive {
+		task.restartFF("osd")
+		w.Write([]byte("restarted"))
+		return
+	}
+	if err := writeTextFile(t.osdFile(&config), text); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Write([]byte("ok"))
+}
+
+// /transform/ticker?newstreampath=xxx&text=xxx 实时修改滚动字幕的文字
+func (t *TransformConfig) Ticker(w http.ResponseWriter, r *http.Request) {
+	task, _ := lookupOwnedTask(w, r)
+	if task == nil {
+		return
+	}
+
+	text := r.URL.Query().Get("text")
+	task.mt.Lock()
+	if task.streamConfig.Ticker == nil {
+		task.mt.Unlock()
+		http.Error(w, "task has no ticker", http.StatusBadRequest)
+		return
+	}
+	//配置可能被其他地方引用，复制后修改
+	ticker := *task.streamConfig.Ticker
+	ticker.Text = text
+	task.streamConfig.Ticker = &ticker
+	config := task.streamConfig
+	config.textID = task.id
+	task.mt.Unlock()
+
+	if err := writeTextFile(t.tickerFile(&config), text); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Write([]byte("ok"))
+}
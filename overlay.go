@@ -0,0 +1,133 @@
+package transform
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// 图片台标，用 movie 读入后 overlay 到画面上
+type Logo struct {
+	Image   string   `yaml:"image"`   //图片路径，相对路径基于 TransformConfig.Path
+	Anchor  string   `yaml:"anchor"`  //topleft topright bottomleft bottomright center，默认 topright
+	X       int      `yaml:"x"`       //相对锚点向画面内的偏移
+	Y       int      `yaml:"y"`       //相对锚点向画面内的偏移
+	Scale   float64  `yaml:"scale"`   //图片缩放倍数，0 为原始大小
+	Opacity *float64 `yaml:"opacity"` //不透明度 0~1，0 为完全透明，省略为 1
+}
+
+// 锚点 → overlay 的 x y 表达式，W H 为画面尺寸，w h 为图片尺寸
+var logoAnchors = map[string][2]string{
+	"topleft":     {"%d", "%d"},
+	"topright":    {"W-w-%d", "%d"},
+	"bottomleft":  {"%d", "H-h-%d"},
+	"bottomright": {"W-w-%d", "H-h-%d"},
+	"center":      {"(W-w)/2+%d", "(H-h)/2+%d"},
+}
+
+// logo.png,topright,10,10,0.5,0.8  锚点之后的字段可省略
+func parseLogo(s string) (logo Logo, err error) {
+	fields := strings.Split(s, ",")
+	if len(fields) > 6 || fields[0] == "" {
+		return logo, fmt.Errorf("invalid logo: %s", s)
+	}
+	logo.Image = fields[0]
+	if len(fields) > 1 {
+		logo.Anchor = fields[1]
+	}
+	for i, v := range []*int{&logo.X, &logo.Y} {
+		if len(fields) > i+2 {
+			if *v, err = strconv.Atoi(fields[i+2]); err != nil {
+				return logo, fmt.Errorf("invalid logo: %s", s)
+			}
+		}
+	}
+	if len(fields) > 4 {
+		if logo.Scale, err = strconv.ParseFloat(fields[4], 64); err != nil {
+			return logo, fmt.Errorf("invalid logo: %s", s)
+		}
+	}
+	if len(fields) > 5 {
+		opacity, err := strconv.ParseFloat(fields[5], 64)
+		if err != nil {
+			return logo, fmt.Errorf("invalid logo: %s", s)
+		}
+		logo.Opacity = &opacity
+	}
+	return logo, nil
+}
+
+func validateLogo(logo *Logo) error {
+	if logo.Image == "" {
+		return fmt.Errorf("logo image is empty")
+	}
+	if _, ok := logoAnchors[logo.Anchor]; logo.Anchor != "" && !ok {
+		return fmt.Errorf("invalid logo anchor: %s", logo.Anchor)
+	}
+	if opacity := logo.opacity(); logo.Scale < 0 || opacity < 0 || opacity > 1 {
+		return fmt.Errorf("invalid logo scale or opacity: %s", logo.Image)
+	}
+	return nil
+}
+
+// 未设置不透明度时不透明
+func (logo *Logo) opacity() float64 {
+	if logo.Opacity == nil {
+		return 1
+	}
+	return *logo.Opacity
+}
+
+// 台标图片的实际路径
+func (t *TransformConfig) logoPath(image string) string {
+	if filepath.IsAbs(image) || t.Path == "" {
+		return image
+	}
+	return filepath.Join(t.Path, image)
+}
+
+// 任务启动前检查台标图片存在
+func (t *TransformConfig) checkLogos(config *StreamConfig) error {
+	for _, logo := range config.Logos {
+		path := t.logoPath(logo.Image)
+		if info, err := os.Stat(path); err != nil {
+			return fmt.Errorf("logo image %s: %w", path, err)
+		} else if info.IsDir() {
+			return fmt.Errorf("logo image %s is a directory", path)
+		}
+	}
+	return nil
+}
+
+// 依次叠加台标，每个台标一路 movie 源
+func (t *TransformConfig) logoFilter(g *filterGraph, config *StreamConfig) {
+	for _, logo := range config.Logos {
+		filters := []string{
+			g.F("movie", "filename="+filterValue(t.logoPath(logo.Image))),
+			g.F("format", "rgba"),
+		}
+		if logo.Scale > 0 {
+			scale := strconv.FormatFloat(logo.Scale, 'f', -1, 64)
+			filters = append(filters, g.F("scale", "w="+filterValue("iw*"+scale), "h="+filterValue("ih*"+scale)))
+		}
+		if opacity := logo.opacity(); opacity < 1 {
+			filters = append(filters, g.F("colorchannelmixer", "aa="+strconv.FormatFloat(opacity, 'f', -1, 64)))
+		}
+		image := g.Label("logo")
+		g.Chain(nil, []string{image}, filters...)
+
+		anchor, ok := logoAnchors[logo.Anchor]
+		if !ok {
+			anchor = logoAnchors["topright"]
+		}
+		main := g.Pad()
+		out := g.Label("v")
+		g.Chain([]string{main, image}, []string{out}, g.F("overlay",
+			"x="+filterValue(fmt.Sprintf(anchor[0], logo.X)),
+			"y="+filterValue(fmt.Sprintf(anchor[1], logo.Y)),
+		))
+		g.Continue(out)
+	}
+}
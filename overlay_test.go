@@ -0,0 +1,43 @@
+package transform
+
+import (
+	"strings"
+	"testing"
+)
+
+// 省略不透明度为不透明，0 为完全透明
+func TestLogoOpacity(t *testing.T) {
+	conf := &TransformConfig{}
+	tests := []struct {
+		logo string
+		want string //colorchannelmixer 参数，空为不调整
+		ok   bool
+	}{
+		{"logo.png", "", true},
+		{"logo.png,topright,10,10,0.5,1", "", true},
+		{"logo.png,topright,10,10,0.5,0.8", "aa=0.8", true},
+		{"logo.png,topright,10,10,0.5,0", "aa=0", true},
+		{"logo.png,topright,10,10,0.5,1.5", "", false},
+		{"logo.png,topright,10,10,0.5,-0.1", "", false},
+	}
+	for _, tt := range tests {
+		logo, err := parseLogo(tt.logo)
+		if err == nil {
+			err = validateLogo(&logo)
+		}
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: %v", tt.logo, err)
+			continue
+		}
+		if !tt.ok {
+			continue
+		}
+		g := newFilterGraph("0:v")
+		conf.logoFilter(g, &StreamConfig{Logos: []Logo{logo}})
+		g.Output("out")
+		_, mixer, found := strings.Cut(g.String(), "colorchannelmixer=")
+		if found != (tt.want != "") || found && !strings.HasPrefix(mixer, tt.want+"[") {
+			t.Errorf("%s: %s", tt.logo, g.String())
+		}
+	}
+}
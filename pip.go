@@ -0,0 +1,111 @@
+package transform
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// 画中画：主画面缩放到输出尺寸后，另一路订阅流缩小叠加在一角
+// 小画面中断时显示占位画面，恢复后自动加回
+type PipConfig struct {
+	StreamPath  string  `yaml:"streampath" json:"streampath"`   //小画面的源流地址
+	Anchor      string  `yaml:"anchor" json:"anchor"`           //topleft topright bottomleft bottomright，默认 bottomright
+	Size        float64 `yaml:"size" json:"size"`               //小画面占主画面宽高的比例 0.1~0.5，默认 0.3
+	Margin      int     `yaml:"margin" json:"margin"`           //距画面边缘的像素，默认 10
+	Placeholder string  `yaml:"placeholder" json:"placeholder"` //占位画面上的文字，默认 NO SIGNAL
+}
+
+// {"streampath":"live/cam2","anchor":"topright","size":0.25}
+func parsePip(s string) (*PipConfig, error) {
+	var pip PipConfig
+	if err := json.Unmarshal([]byte(s), &pip); err != nil {
+		return nil, fmt.Errorf("invalid pip: %w", err)
+	}
+	return &pip, nil
+}
+
+func defaultPipConfig(config *StreamConfig) {
+	pip := config.Pip
+	if config.TransType != TransTypePip || pip == nil {
+		return
+	}
+	if pip.Anchor == "" {
+		pip.Anchor = "bottomright"
+	}
+	if pip.Size == 0 {
+		pip.Size = 0.3
+	}
+	if pip.Margin == 0 {
+		pip.Margin = 10
+	}
+	if pip.Placeholder == "" {
+		pip.Placeholder = "NO SIGNAL"
+	}
+}
+
+func validatePip(config *StreamConfig) error {
+	if config.TransType != TransTypePip {
+		if config.Pip != nil {
+			return errors.New("pip requires transtype 5")
+		}
+		return nil
+	}
+	//小画面从 fd 3 起的管道输入
+	if err := checkExtraPipes(config); err != nil {
+		return err
+	}
+	pip := config.Pip
+	if pip == nil || pip.StreamPath == "" {
+		return errors.New("pip streampath is empty")
+	}
+	if pip.StreamPath == config.StreamPath {
+		return errors.New("pip streampath is the same as streampath")
+	}
+	//小画面的尺寸由输出尺寸计算
+	res, _ := parseResolution(config.Resolution)
+	if !res.boxed() || res.Max {
+		return errors.New("pip requires a w*h resolution")
+	}
+	if _, ok := logoAnchors[pip.Anchor]; !ok || pip.Anchor == "center" {
+		return fmt.Errorf("invalid pip anchor: %s", pip.Anchor)
+	}
+	if pip.Size < 0.1 || pip.Size > 0.5 || pip.Margin < 0 {
+		return fmt.Errorf("invalid pip size or margin: %g %d", pip.Size, pip.Margin)
+	}
+	return nil
+}
+
+// 小画面的尺寸，取偶数
+func pipSize(config *StreamConfig) (w, h int) {
+	res, _ := parseResolution(config.Resolution)
+	w = int(float64(res.W)*config.Pip.Size) / 2 * 2
+	h = int(float64(res.H)*config.Pip.Size) / 2 * 2
+	return
+}
+
+// 小画面有画面时叠加小画面，没有画面时叠加占位画面；小画面中途卡住或结束时 ffmpeg 原地重启换成占位画面
+func (t *TransformConfig) pipFilter(g *filterGraph, config *StreamConfig) {
+	pip := config.Pip
+	w, h := pipSize(config)
+	anchor := logoAnchors[pip.Anchor]
+	x := filterValue(fmt.Sprintf(anchor[0], pip.Margin))
+	y := filterValue(fmt.Sprintf(anchor[1], pip.Margin))
+
+	var ins, filters []string
+	//小画面结束后只保留主画面，占位画面没有时长，随主画面结束
+	eof := "eof_action=pass"
+	if n, ok := extraInputIndex(config, pip.StreamPath); ok {
+		ins = []string{fmt.Sprintf("%d:v", n)}
+		filters = fitFilters(g, w, h)
+	} else {
+		filters = t.placeholderFilters(g, config, pip.Placeholder, w, h)
+		eof = "shortest=1"
+	}
+	inset := g.Label("pip")
+	g.Chain(ins, []string{inset}, filters...)
+	main := g.Pad()
+	out := g.Label("v")
+	g.Chain([]string{main, inset}, []string{out}, g.F("overlay", "x="+x, "y="+y, eof))
+	g.Continue(out)
+}
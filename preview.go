@@ -0,0 +1,156 @@
+package transform
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"os"
+	"os/exec"
+	"time"
+)
+
+// 滤镜图校验的最长时间
+const previewValidateTimeout = 10 * time.Second
+
+// 预览结果
+type PreviewResult struct {
+	Config StreamConfig `json:"config"`
+	Argv   []string     `json:"argv"`
+	Filter string       `json:"filter"`
+
+	Valid     *bool    `json:"valid,omitempty"`     //请求 validate 时返回滤镜图是否可用
+	Validated []string `json:"validated,omitempty"` //校验过的滤镜图，附加输入有无画面、垫片时的滤镜图不同，分别校验
+	Output    string   `json:"output,omitempty"`    //校验时 ffmpeg 的错误输出
+}
+
+// 运行时可能使用的一种滤镜图
+type previewGraph struct {
+	name    string
+	command *ffmpegCommand
+	inputs  int //ffmpeg 的视频输入个数，校验时每个输入一路合成画面
+}
+
+// 任务运行时可能使用的各种滤镜图：附加输入都有画面、都没有画面（占位画面）、源中断输出垫片
+func (t *TransformConfig) previewGraphs(config *StreamConfig) []previewGraph {
+	mainInputs := 0
+	if hasMainInput(config) {
+		mainInputs = 1
+	}
+	sources := extraSources(config)
+	c := *config
+	c.inputLive = make(map[string]bool)
+	for _, path := range sources {
+		c.inputLive[path] = true
+	}
+	command := t.ffmpegCommand(&c)
+	graphs := []previewGraph{{name: "inputs live", command: command, inputs: mainInputs + command.ExtraIns}}
+	if len(sources) > 0 {
+		c.inputLive = nil
+		graphs = append(graphs, previewGraph{name: "inputs lost", command: t.ffmpegCommand(&c), inputs: mainInputs})
+	}
+	if config.Slate != nil {
+		c.slateActive = true
+		inputs := 0
+		if config.Slate.Image != "" {
+			inputs = 1
+		}
+		graphs = append(graphs, previewGraph{name: "slate", command: t.ffmpegCommand(&c), inputs: inputs})
+	}
+	return graphs
+}
+
+// /transform/preview?streampath=xxx&osdtext=xxx&validate=1
+// 参数与 /transform/ 相同，返回补全默认值后的配置和将要执行的 ffmpeg 命令，不启动任务
+// validate=1 时用合成画面跑一遍滤镜图校验是否可用
+func (t *TransformConfig) Preview(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	streamConfig := apiStreamConfig()
+	if err := parseStreamConfig(query, &streamConfig); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := t.resolveStreamConfig(&streamConfig); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	//实时文字文件使用预览自己的编号，不会与运行中的任务冲突
+	streamConfig.textID = "preview-" + newTaskID()
+	//数字云台的 zmq 端口与任务一样临时分配，不会绑到运行中任务的端口上收到发给它的命令
+	if streamConfig.TransType == TransTypePtz {
+		addr, err := freePtzAddr()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		streamConfig.ptzAddr = addr
+	}
+
+	transcoder, err := t.newTranscoder()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	argv, err := transcoder.Argv(&streamConfig)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	command := t.ffmpegCommand(&streamConfig)
+	result := PreviewResult{
+		Config: streamConfig,
+		Argv:   argv,
+		Filter: command.Filter.String(),
+	}
+
+	if query.Get("validate") == "1" {
+		valid := true
+		for _, graph := range t.previewGraphs(&streamConfig) {
+			result.Validated = append(result.Validated, graph.name)
+			if ok, output := t.validateFilter(r.Context(), &streamConfig, graph.command, graph.inputs); !ok {
+				valid = false
+				result.Output += graph.name + ": " + output
+				break
+			}
+		}
+		result.Valid = &valid
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// 每个视频输入用一路 testsrc 合成画面，跑一秒滤镜图，输出丢弃
+func (t *TransformConfig) validateFilter(ctx context.Context, config *StreamConfig, command *ffmpegCommand, inputs int) (bool, string) {
+	ctx, cancel := context.WithTimeout(ctx, previewValidateTimeout)
+	defer cancel()
+
+	//滤镜图读取的实时文字文件只在校验期间存在
+	for path, text := range t.textFiles(config) {
+		if err := writeTextFile(path, text); err != nil {
+			return false, err.Error()
+		}
+		defer os.Remove(path)
+	}
+
+	res, _ := parseResolution(config.Resolution)
+	size := res.testSize()
+	args := []string{"-hide_banner", "-loglevel", "error"}
+	for i := 0; i < inputs; i++ {
+		args = append(args, "-f", "lavfi", "-i", "testsrc=duration=1:size="+size+":rate="+config.Fps)
+	}
+	args = append(args, "-filter_complex", command.Filter.String())
+	//画面拼接的 color 源没有时长，输出也限制为一秒
+	for _, out := range command.FilterOutputs {
+		args = append(args, "-map", "["+out+"]", "-t", "1", "-f", "null", "-")
+	}
+	cmd := exec.CommandContext(ctx, t.Ffmpeg, args...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	err := cmd.Run()
+	output := stderr.String()
+	if err != nil && output == "" {
+		output = err.Error()
+	}
+	return err == nil, output
+}
@@ -0,0 +1,354 @@
+package transform
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// 数字云台：在源画面上裁剪一块区域缩放输出，通过 ffmpeg zmq 滤镜向 crop@ptz 发送命令实时移动，
+// 插值在插件中进行，逐步发送中间位置
+
+// 云台位置，X Y 为裁剪区域中心相对源画面的比例 0~1，Zoom 为放大倍数 >=1
+type PtzPosition struct {
+	X    float64 `yaml:"x" json:"x"`
+	Y    float64 `yaml:"y" json:"y"`
+	Zoom float64 `yaml:"zoom" json:"zoom"`
+}
+
+type PtzConfig struct {
+	X        float64                `yaml:"x"` //初始位置
+	Y        float64                `yaml:"y"`
+	Zoom     float64                `yaml:"zoom"`
+	Duration int                    `yaml:"duration"` //移动的过渡时间，毫秒，默认 1000，0 以下为直接跳转
+	Presets  map[string]PtzPosition `yaml:"presets"`  //预置位
+}
+
+func (p *PtzConfig) position() PtzPosition {
+	return PtzPosition{X: p.X, Y: p.Y, Zoom: p.Zoom}
+}
+
+func validPtzPosition(pos PtzPosition) error {
+	if pos.X < 0 || pos.X > 1 || pos.Y < 0 || pos.Y > 1 || pos.Zoom < 1 {
+		return fmt.Errorf("invalid ptz position: %+v", pos)
+	}
+	return nil
+}
+
+func validatePtz(config *StreamConfig) error {
+	if config.TransType != TransTypePtz {
+		if config.Ptz != nil {
+			return errors.New("ptz requires transtype 4")
+		}
+		return nil
+	}
+	res, _ := parseResolution(config.Resolution)
+	if !res.boxed() || res.Max {
+		return errors.New("ptz requires a w*h resolution")
+	}
+	if config.Ptz == nil {
+		return errors.New("ptz config is empty")
+	}
+	if err := validPtzPosition(config.Ptz.position()); err != nil {
+		return err
+	}
+	for name, pos := range config.Ptz.Presets {
+		if err := validPtzPosition(pos); err != nil {
+			return fmt.Errorf("preset %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// 默认位置为画面中心，不放大
+func defaultPtzConfig(config *StreamConfig) {
+	if config.TransType != TransTypePtz {
+		return
+	}
+	if config.Ptz == nil {
+		config.Ptz = &PtzConfig{X: 0.5, Y: 0.5}
+	}
+	if config.Ptz.Zoom == 0 {
+		config.Ptz.Zoom = 1
+	}
+}
+
+// 任务运行时的云台状态
+type ptzState struct {
+	mu   sync.Mutex
+	addr string //zmq 滤镜监听地址，ffmpeg 重启后不变，端口被占用时才更换
+	req  *zmqReq
+	pos  PtzPosition //已发送给 ffmpeg 的位置
+	seq  int         //新的移动开始后旧的停止
+}
+
+func newPtzState(pos PtzPosition) (*ptzState, error) {
+	addr, err := freePtzAddr()
+	if err != nil {
+		return nil, err
+	}
+	return &ptzState{addr: addr, req: &zmqReq{addr: addr}, pos: pos}, nil
+}
+
+// 找一个空闲端口给 zmq 滤镜，关闭后到 ffmpeg 绑定前可能被其他进程占用，由 checkAddr 更换
+func freePtzAddr() (string, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", err
+	}
+	defer l.Close()
+	return "tcp://" + l.Addr().String(), nil
+}
+
+// 每次启动 ffmpeg 前确认端口仍然空闲，被其他进程占用（上次 ffmpeg 因此绑定失败退出）时换一个端口重试
+func (p *ptzState) checkAddr() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	l, err := net.Listen("tcp", strings.TrimPrefix(p.addr, "tcp://"))
+	if err == nil {
+		l.Close()
+		return nil
+	}
+	addr, err := freePtzAddr()
+	if err != nil {
+		return err
+	}
+	TransformPlugin.Warn("ptz zmq port in use", zap.String("addr", p.addr), zap.String("newAddr", addr))
+	p.req.Close()
+	p.addr, p.req = addr, &zmqReq{addr: addr}
+	return nil
+}
+
+func (p *ptzState) address() string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.addr
+}
+
+func (p *ptzState) close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.req.Close()
+}
+
+func (p *ptzState) position() PtzPosition {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.pos
+}
+
+// 裁剪区域，宽高取偶数，区域不超出画面。高与 ptzFilter 的表达式一致，由宽按画面宽高比推导
+func ptzCrop(pos PtzPosition, source SourceInfo) (w, h, x, y int) {
+	w = int(float64(source.Width)/pos.Zoom) / 2 * 2
+	h = int(float64(w)*float64(source.Height)/float64(source.Width)) / 2 * 2
+	x = int(math.Round(pos.X*float64(source.Width))) - w/2
+	y = int(math.Round(pos.Y*float64(source.Height))) - h/2
+	x = int(math.Max(0, math.Min(float64(source.Width-w), float64(x))))
+	y = int(math.Max(0, math.Min(float64(source.Height-h), float64(y))))
+	return
+}
+
+// 把位置发送给 crop@ptz，只有缩放变化时才改宽，高随宽重新求值，不会出现宽高比不对的中间帧
+// source 为 crop@ptz 的输入尺寸
+func (p *ptzState) send(pos, last PtzPosition, source SourceInfo) error {
+	w, _, x, y := ptzCrop(pos, source)
+	cmds := []string{fmt.Sprintf("x %d", x), fmt.Sprintf("y %d", y)}
+	if pos.Zoom != last.Zoom {
+		cmds = append([]string{fmt.Sprintf("w %d", w)}, cmds...)
+	}
+	for _, cmd := range cmds {
+		reply, err := p.req.Request("crop@ptz " + cmd)
+		if err != nil {
+			return err
+		}
+		//应答为 "0 Success" 或 "错误码 错误信息"
+		if !strings.HasPrefix(reply, "0 ") {
+			return fmt.Errorf("ptz command %s: %s", cmd, reply)
+		}
+	}
+	return nil
+}
+
+// zmq 滤镜加带实例名的 crop，初始位置用表达式，源尺寸不需要事先知道
+// crop 每次收到命令都会重新求值宽高表达式，高写成 ow 的函数，只发送 w 就能同时改变宽高
+func ptzFilter(g *filterGraph, config *StreamConfig) {
+	pos := config.Ptz.position()
+	//端口由任务或预览用 freePtzAddr 分配
+	addr := config.ptzAddr
+	zoom := strconv.FormatFloat(pos.Zoom, 'f', -1, 64)
+	g.Filter("zmq", "bind_address="+filterValue(addr))
+	g.Filter("crop@ptz",
+		"w="+filterValue("2*trunc(iw/"+zoom+"/2)"),
+		"h="+filterValue("2*trunc(ow*ih/iw/2)"),
+		"x="+filterValue(fmt.Sprintf("max(0,min(iw-ow,iw*%g-ow/2))", pos.X)),
+		"y="+filterValue(fmt.Sprintf("max(0,min(ih-oh,ih*%g-oh/2))", pos.Y)),
+	)
+}
+
+// 平滑移动到目标位置，duration 内按时间比例逐步发送中间位置
+func (t *TransformTask) ptzMove(target PtzPosition, duration time.Duration) error {
+	t.mt.Lock()
+	//crop@ptz 在裁剪、旋转之后，坐标基于摆正后的画面
+	source := orientedSize(&t.streamConfig, t.source)
+	ptz := t.ptz
+	t.mt.Unlock()
+	if ptz == nil {
+		return errors.New("task is not ptz")
+	}
+	if source.Width == 0 {
+		return errors.New("source size unknown")
+	}
+
+	ptz.mu.Lock()
+	ptz.seq++
+	seq := ptz.seq
+	start := ptz.pos
+	ptz.mu.Unlock()
+
+	step := func(pos PtzPosition) error {
+		ptz.mu.Lock()
+		defer ptz.mu.Unlock()
+		if ptz.seq != seq {
+			return errors.New("ptz move canceled")
+		}
+		if err := ptz.send(pos, ptz.pos, source); err != nil {
+			return err
+		}
+		ptz.pos = pos
+		return nil
+	}
+
+	if duration <= 0 {
+		return step(target)
+	}
+	go func() {
+		begin := time.Now()
+		for {
+			frac := float64(time.Since(begin)) / float64(duration)
+			if frac >= 1 {
+				break
+			}
+			//缩放按对数插值，视觉上匀速
+			pos := PtzPosition{
+				X:    start.X + (target.X-start.X)*frac,
+				Y:    start.Y + (target.Y-start.Y)*frac,
+				Zoom: start.Zoom * math.Pow(target.Zoom/start.Zoom, frac),
+			}
+			if err := step(pos); err != nil {
+				TransformPlugin.Warn("ptz move", zap.Error(err))
+				return
+			}
+			time.Sleep(40 * time.Millisecond)
+		}
+		if err := step(target); err != nil {
+			TransformPlugin.Warn("ptz move", zap.Error(err))
+		}
+	}()
+	return nil
+}
+
+// 云台状态
+type PtzResult struct {
+	Position PtzPosition            `json:"position"`
+	Presets  map[string]PtzPosition `json:"presets"`
+}
+
+// /transform/ptz?newstreampath=xxx&x=0.5&y=0.5&zoom=2&duration=1000
+// /transform/ptz?newstreampath=xxx&preset=door 调用预置位
+// /transform/ptz?newstreampath=xxx&save=door 把当前位置保存为预置位
+func (t *TransformConfig) Ptz(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	task, _ := lookupTask(w, r)
+	if task == nil {
+		return
+	}
+	task.mt.Lock()
+	ptz := task.ptz
+	var config PtzConfig
+	if task.streamConfig.Ptz != nil {
+		config = *task.streamConfig.Ptz
+	}
+	task.mt.Unlock()
+	if ptz == nil {
+		http.Error(w, "task is not ptz", http.StatusBadRequest)
+		return
+	}
+
+	target := ptz.position()
+	duration := config.Duration
+	if duration == 0 {
+		duration = 1000
+	}
+	var err error
+	parse := func(key string, v *float64) {
+		if err == nil && query.Has(key) {
+			if *v, err = strconv.ParseFloat(query.Get(key), 64); err != nil {
+				err = fmt.Errorf("invalid %s: %s", key, query.Get(key))
+			}
+		}
+	}
+	switch {
+	case query.Has("save"):
+		//预置位保存到任务配置，复制后修改
+		presets := make(map[string]PtzPosition)
+		for k, v := range config.Presets {
+			presets[k] = v
+		}
+		presets[query.Get("save")] = target
+		config.Presets = presets
+		task.mt.Lock()
+		task.streamConfig.Ptz = &config
+		task.mt.Unlock()
+	case query.Has("preset"):
+		pos, ok := config.Presets[query.Get("preset")]
+		if !ok {
+			http.Error(w, "preset not found: "+query.Get("preset"), http.StatusNotFound)
+			return
+		}
+		target = pos
+	default:
+		parse("x", &target.X)
+		parse("y", &target.Y)
+		parse("zoom", &target.Zoom)
+	}
+	if err == nil && query.Has("duration") {
+		duration, err = strconv.Atoi(query.Get("duration"))
+	}
+	if err == nil {
+		err = validPtzPosition(target)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !query.Has("save") {
+		if err := task.ptzMove(target, time.Duration(duration)*time.Millisecond); err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(PtzResult{Position: target, Presets: config.Presets})
+}
+
+// ffmpeg 重启后从当前位置继续，zmq 地址不变
+func (t *TransformTask) ptzConfig(config *StreamConfig) {
+	if t.ptz == nil || config.Ptz == nil {
+		return
+	}
+	ptz := *config.Ptz
+	pos := t.ptz.position()
+	ptz.X, ptz.Y, ptz.Zoom = pos.X, pos.Y, pos.Zoom
+	config.Ptz = &ptz
+	config.ptzAddr = t.ptz.address()
+}
@@ -0,0 +1,115 @@
+package transform
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestPtzCrop(t *testing.T) {
+	source := SourceInfo{Width: 3840, Height: 2160}
+	tests := []struct {
+		pos        PtzPosition
+		w, h, x, y int
+	}{
+		{PtzPosition{X: 0.5, Y: 0.5, Zoom: 1}, 3840, 2160, 0, 0},
+		{PtzPosition{X: 0.5, Y: 0.5, Zoom: 2}, 1920, 1080, 960, 540},
+		{PtzPosition{X: 0, Y: 0, Zoom: 2}, 1920, 1080, 0, 0},       //不超出左上
+		{PtzPosition{X: 1, Y: 1, Zoom: 2}, 1920, 1080, 1920, 1080}, //不超出右下
+		{PtzPosition{X: 0.5, Y: 0.5, Zoom: 3}, 1280, 720, 1280, 720},
+	}
+	for _, test := range tests {
+		w, h, x, y := ptzCrop(test.pos, source)
+		if w != test.w || h != test.h || x != test.x || y != test.y {
+			t.Errorf("ptzCrop(%+v) = %d %d %d %d, want %d %d %d %d", test.pos, w, h, x, y, test.w, test.h, test.x, test.y)
+		}
+	}
+}
+
+func TestOrientedSize(t *testing.T) {
+	source := SourceInfo{Width: 1920, Height: 1080}
+	tests := []struct {
+		crop   string
+		rotate int
+		want   SourceInfo
+	}{
+		{"", 0, source},
+		{"", 90, SourceInfo{Width: 1080, Height: 1920}},
+		{"1280*720+10+10", 0, SourceInfo{Width: 1280, Height: 720}},
+		{"1280x720", 270, SourceInfo{Width: 720, Height: 1280}},
+	}
+	for _, test := range tests {
+		config := StreamConfig{Crop: test.crop, Rotate: test.rotate}
+		if got := orientedSize(&config, source); got != test.want {
+			t.Errorf("orientedSize(%q, %d) = %v, want %v", test.crop, test.rotate, got, test.want)
+		}
+	}
+	if got := orientedSize(&StreamConfig{Rotate: 90}, SourceInfo{}); got != (SourceInfo{}) {
+		t.Errorf("unknown source = %v", got)
+	}
+}
+
+func TestPtzCheckAddr(t *testing.T) {
+	ptz, err := newPtzState(PtzPosition{X: 0.5, Y: 0.5, Zoom: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ptz.close()
+	addr := ptz.address()
+	if err := ptz.checkAddr(); err != nil || ptz.address() != addr {
+		t.Fatalf("free port changed: %s -> %s %v", addr, ptz.address(), err)
+	}
+
+	//端口被其他进程占用后换一个
+	l, err := net.Listen("tcp", strings.TrimPrefix(addr, "tcp://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	if err := ptz.checkAddr(); err != nil {
+		t.Fatal(err)
+	}
+	if ptz.address() == addr {
+		t.Errorf("port in use was kept: %s", addr)
+	}
+}
+
+// 预览与任务一样临时分配 zmq 端口，不占用运行中任务的端口
+func TestPtzPreviewAddr(t *testing.T) {
+	conf := fakeFfmpegConfig(t, "copy")
+	ptz, err := newPtzState(PtzPosition{X: 0.5, Y: 0.5, Zoom: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ptz.close()
+	//运行中任务的 ffmpeg 已绑定端口
+	l, err := net.Listen("tcp", strings.TrimPrefix(ptz.address(), "tcp://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	rec := httptest.NewRecorder()
+	conf.Preview(rec, httptest.NewRequest(http.MethodGet, "/transform/preview?streampath=live/a&newstreampath=test/ptz&transtype=4&resolution=1280*720", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("preview: %d %s", rec.Code, rec.Body)
+	}
+	var result PreviewResult
+	if err := json.Unmarshal(rec.Body.Bytes(), &result); err != nil {
+		t.Fatal(err)
+	}
+	_, addr, _ := strings.Cut(result.Filter, "bind_address=")
+	addr, _, _ = strings.Cut(addr, ",")
+	addr = strings.ReplaceAll(addr, `\`, "")
+	if !strings.HasPrefix(addr, "tcp://127.0.0.1:") || addr == ptz.address() {
+		t.Errorf("preview zmq address %q", addr)
+	}
+	if l, err := net.Listen("tcp", strings.TrimPrefix(addr, "tcp://")); err != nil {
+		t.Errorf("preview port not free: %v", err)
+	} else {
+		l.Close()
+	}
+}
@@ -0,0 +1,115 @@
+package transform
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+)
+
+// 拉取外部地址：ffmpeg 直接读取任意地址（rtsp http(s) 的 hls srt udp 组播、本地文件），
+// 转码后同样以 ts 流发布到 newstreampath，用于接入 m7s 没有拉流插件的设备。
+// ffmpeg 因断流退出时保留发布者，等待 reconnectdelay 后重新拉取
+type PullConfig struct {
+	URL            string `yaml:"url" json:"url"`                       //rtsp://  http://  srt://  udp://@239.0.0.1:1234  本地文件路径
+	Transport      string `yaml:"transport" json:"transport"`           //rtsp 的传输方式 tcp（默认） udp
+	Timeout        int    `yaml:"timeout" json:"timeout"`               //读取超时，毫秒，默认 5000，超时后 ffmpeg 退出重连
+	ReconnectDelay int    `yaml:"reconnectdelay" json:"reconnectdelay"` //断开后多久重新拉取，毫秒，默认 2000
+}
+
+func defaultPullConfig(config *StreamConfig) {
+	pull := config.Pull
+	if config.TransType != TransTypePull || pull == nil {
+		return
+	}
+	if pull.Transport == "" {
+		pull.Transport = "tcp"
+	}
+	if pull.Timeout == 0 {
+		pull.Timeout = 5000
+	}
+	if pull.ReconnectDelay == 0 {
+		pull.ReconnectDelay = 2000
+	}
+}
+
+// 地址的协议，本地文件为 file
+func pullScheme(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	//windows 盘符 c:\ 会被当作协议
+	if err != nil || len(u.Scheme) <= 1 {
+		return "file"
+	}
+	return u.Scheme
+}
+
+func validatePull(config *StreamConfig) error {
+	if config.TransType != TransTypePull {
+		if config.Pull != nil {
+			return errors.New("pull requires transtype 7")
+		}
+		return nil
+	}
+	pull := config.Pull
+	if pull == nil || pull.URL == "" {
+		return errors.New("pull url is empty")
+	}
+	switch pullScheme(pull.URL) {
+	case "rtsp", "rtsps", "http", "https", "srt", "udp", "rtp", "file":
+	default:
+		return fmt.Errorf("unsupported pull url: %s", pull.URL)
+	}
+	if pull.Transport != "tcp" && pull.Transport != "udp" {
+		return fmt.Errorf("invalid pull transport: %s", pull.Transport)
+	}
+	if pull.Timeout < 0 || pull.ReconnectDelay < 0 {
+		return errors.New("pull timeout and reconnectdelay must not be negative")
+	}
+	return nil
+}
+
+// 本地文件的实际路径，相对路径基于 TransformConfig.Path
+func (t *TransformConfig) pullPath(rawURL string) string {
+	if u, err := url.Parse(rawURL); err == nil && u.Scheme == "file" {
+		return t.logoPath(u.Path)
+	}
+	return t.logoPath(rawURL)
+}
+
+// 任务启动前检查本地文件存在
+func (t *TransformConfig) checkPull(config *StreamConfig) error {
+	if config.Pull == nil || pullScheme(config.Pull.URL) != "file" {
+		return nil
+	}
+	path := t.pullPath(config.Pull.URL)
+	if info, err := os.Stat(path); err != nil {
+		return fmt.Errorf("pull file %s: %w", path, err)
+	} else if info.IsDir() {
+		return fmt.Errorf("pull file %s is a directory", path)
+	}
+	return nil
+}
+
+// 按协议加超时和重连参数，本地文件按实时速度读取
+func (t *TransformConfig) pullInputArgs(config *StreamConfig) []string {
+	pull := config.Pull
+	timeout := strconv.Itoa(pull.Timeout * 1000) //微秒
+	var args []string
+	switch pullScheme(pull.URL) {
+	case "rtsp", "rtsps":
+		args = append(args, "-rtsp_transport", pull.Transport, "-timeout", timeout)
+	case "http", "https":
+		args = append(args, "-reconnect", "1", "-reconnect_streamed", "1", "-reconnect_delay_max", "5", "-rw_timeout", timeout)
+	case "file":
+		return []string{"-re", "-i", t.pullPath(pull.URL)}
+	default:
+		args = append(args, "-rw_timeout", timeout)
+	}
+	return append(args, "-i", pull.URL)
+}
+
+func pullReconnectDelay(config *StreamConfig) time.Duration {
+	return time.Duration(config.Pull.ReconnectDelay) * time.Millisecond
+}
@@ -0,0 +1,89 @@
+package transform
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestPullInputArgs(t *testing.T) {
+	conf := &TransformConfig{Path: filepath.FromSlash("/data")}
+	tests := []struct {
+		url  string
+		want string
+	}{
+		{"rtsp://cam/1", "-rtsp_transport tcp -timeout 5000000 -i rtsp://cam/1"},
+		{"http://x/a.m3u8", "-reconnect 1 -reconnect_streamed 1 -reconnect_delay_max 5 -rw_timeout 5000000 -i http://x/a.m3u8"},
+		{"srt://h:1", "-rw_timeout 5000000 -i srt://h:1"},
+		{"media/a.mp4", "-re -i " + filepath.Join(conf.Path, "media/a.mp4")},
+	}
+	for _, test := range tests {
+		config := StreamConfig{TransType: TransTypePull, Pull: &PullConfig{URL: test.url}}
+		defaultPullConfig(&config)
+		if err := validatePull(&config); err != nil {
+			t.Errorf("%s: %v", test.url, err)
+		}
+		if got := strings.Join(conf.pullInputArgs(&config), " "); got != test.want {
+			t.Errorf("pullInputArgs(%s) = %q, want %q", test.url, got, test.want)
+		}
+	}
+	if err := validatePull(&StreamConfig{TransType: TransTypePull, Pull: &PullConfig{URL: "ftp://x/a", Transport: "tcp"}}); err == nil {
+		t.Error("ftp accepted")
+	}
+}
+
+func TestFileInputArgs(t *testing.T) {
+	conf := &TransformConfig{Path: filepath.FromSlash("/data")}
+	path := filepath.Join(conf.Path, "a.mp4")
+	tests := []struct {
+		file FileConfig
+		want string
+	}{
+		{FileConfig{Path: "a.mp4"}, "-stream_loop -1 -re -i " + path},
+		{FileConfig{Path: "a.mp4", Offset: 1.5}, "-stream_loop -1 -re -ss 1.5 -i " + path},
+	}
+	for _, test := range tests {
+		config := StreamConfig{TransType: TransTypeFile, File: &test.file}
+		if err := validateFile(&config); err != nil {
+			t.Errorf("%+v: %v", test.file, err)
+		}
+		if got := strings.Join(conf.fileInputArgs(&config), " "); got != test.want {
+			t.Errorf("fileInputArgs(%+v) = %q, want %q", test.file, got, test.want)
+		}
+	}
+	for _, bad := range []string{"", "../a.mp4", filepath.FromSlash("/etc/passwd")} {
+		if err := validateFile(&StreamConfig{TransType: TransTypeFile, File: &FileConfig{Path: bad}}); err == nil {
+			t.Errorf("file path %q accepted", bad)
+		}
+	}
+}
+
+// 本地文件在任务启动前检查
+func TestCheckLocalFile(t *testing.T) {
+	conf := &TransformConfig{Path: t.TempDir()}
+	if err := os.WriteFile(filepath.Join(conf.Path, "a.mp4"), []byte{0}, 0644); err != nil {
+		t.Fatal(err)
+	}
+	for url, ok := range map[string]bool{"a.mp4": true, "file://" + filepath.ToSlash(filepath.Join(conf.Path, "a.mp4")): true, "b.mp4": false, ".": false, "rtsp://cam/1": true} {
+		if err := conf.checkPull(&StreamConfig{Pull: &PullConfig{URL: url}}); (err == nil) != ok {
+			t.Errorf("checkPull(%s) = %v", url, err)
+		}
+	}
+	//指向目录外的符号链接不能读取，指向目录内的可以
+	outside := filepath.Join(t.TempDir(), "secret.mp4")
+	if err := os.WriteFile(outside, []byte{0}, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(outside, filepath.Join(conf.Path, "escape.mp4")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(filepath.Join(conf.Path, "a.mp4"), filepath.Join(conf.Path, "inside.mp4")); err != nil {
+		t.Fatal(err)
+	}
+	for path, ok := range map[string]bool{"a.mp4": true, "b.mp4": false, ".": false, "escape.mp4": false, "inside.mp4": true} {
+		if err := conf.checkFile(&StreamConfig{File: &FileConfig{Path: path}}); (err == nil) != ok {
+			t.Errorf("checkFile(%s) = %v", path, err)
+		}
+	}
+}
@@ -0,0 +1,277 @@
+package transform
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// 推送到外部地址：用 tee 封装一次编码同时输出到内部发布管道和各外部地址，
+// 外部地址失败时 tee 去掉这一路继续（onfail=ignore），按各自的退避时间原地重启 ffmpeg 重新加入。
+// tee 不能单独重新打开一路，重试会让其他地址和本机发布重连一次，连续重试 maxretries 次仍失败后不再重试
+type PushOutput struct {
+	URL        string `yaml:"url" json:"url"`               //rtmp:// rtmps:// srt:// udp:// rtp:// icecast://
+	Format     string `yaml:"format" json:"format"`         //封装格式，默认 rtmp 为 flv，rtp 为 rtp_mpegts，其余为 mpegts
+	RetryDelay int    `yaml:"retrydelay" json:"retrydelay"` //失败后首次重试的等待，毫秒，默认 2000，连续失败时加倍，最长 60 秒
+	MaxRetries int    `yaml:"maxretries" json:"maxretries"` //连续重试多少次仍失败后不再重试，默认 10
+}
+
+// 外部地址运行时状态
+type pushState struct {
+	state     string //pending 等待启动 running 推送中 failed 失败等待重试 stopped 不再重试
+	failures  int    //连续失败次数
+	lastError string
+	since     time.Time //开始推送的时间
+	retryAt   time.Time
+}
+
+// 推送状态
+type PushStatus struct {
+	URL       string    `json:"url"`
+	State     string    `json:"state"`
+	Failures  int       `json:"failures"`
+	LastError string    `json:"lastError,omitempty"`
+	RetryAt   time.Time `json:"retryAt,omitempty"`
+}
+
+// 推送持续这么久后失败次数清零
+const pushStableTime = time.Minute
+
+const pushMaxRetryDelay = 60 * time.Second
+
+const pushDefaultMaxRetries = 10
+
+// tee 日志：Slave muxer #1 failed: Connection refused, continuing with 1/2 slaves.
+var teeFailRegexp = regexp.MustCompile(`Slave muxer #(\d+) failed: (.*), continuing with`)
+
+func pushFormat(output *PushOutput) string {
+	if output.Format != "" {
+		return output.Format
+	}
+	switch pullScheme(output.URL) {
+	case "rtmp", "rtmps":
+		return "flv"
+	case "rtp":
+		return "rtp_mpegts"
+	}
+	return "mpegts"
+}
+
+func validatePush(config *StreamConfig) error {
+	if len(config.Push) == 0 {
+		if config.PushOnly {
+			return errors.New("pushonly requires push outputs")
+		}
+		return nil
+	}
+	switch config.TransType {
+	case TransTypePipe, TransTypePtz, TransTypePip, TransTypeMosaic, TransTypePull, TransTypeFile:
+	default:
+		return fmt.Errorf("push is not supported by transtype %d", config.TransType)
+	}
+	seen := make(map[string]bool)
+	for _, output := range config.Push {
+		u, err := url.Parse(output.URL)
+		if err != nil {
+			return fmt.Errorf("invalid push url: %s", output.URL)
+		}
+		switch u.Scheme {
+		case "rtmp", "rtmps", "srt", "udp", "rtp", "icecast":
+		default:
+			return fmt.Errorf("unsupported push url: %s", output.URL)
+		}
+		if seen[output.URL] {
+			return fmt.Errorf("duplicate push url: %s", output.URL)
+		}
+		seen[output.URL] = true
+		if output.RetryDelay < 0 {
+			return fmt.Errorf("invalid push retrydelay: %d", output.RetryDelay)
+		}
+		if output.MaxRetries < 0 {
+			return fmt.Errorf("invalid push maxretries: %d", output.MaxRetries)
+		}
+	}
+	return nil
+}
+
+// 本次启动包含的外部地址序号，pushActive 为空时全部包含
+func activePushOutputs(config *StreamConfig) []int {
+	var active []int
+	for i := range config.Push {
+		if config.pushActive == nil || config.pushActive[i] {
+			active = append(active, i)
+		}
+	}
+	return active
+}
+
+// 单路输出的封装参数：没有外部地址时 ts 直接输出到管道，否则用 tee 一次编码输出到所有地址
+// flv 需要全局头，这时 ts 输出用 dump_extra 在关键帧前补上 SPS PPS
+func outputArgs(config *StreamConfig) (args []string, pipeOuts int) {
+	if !config.PushOnly {
+		pipeOuts = 1
+	}
+	active := activePushOutputs(config)
+	if len(active) == 0 {
+		if pipeOuts == 0 {
+			//只推送且都在等待重试，丢弃输出
+			return []string{"-f", "null", "-"}, 0
+		}
+		return []string{"-f", "mpegts", pipeOut(0)}, 1
+	}
+	globalHeader := false
+	for _, i := range active {
+		if pushFormat(&config.Push[i]) == "flv" {
+			globalHeader = true
+		}
+	}
+	extra := ""
+	if globalHeader {
+		extra = ":bsfs/v=dump_extra"
+		args = append(args, "-flags", "+global_header")
+	}
+	var slaves []string
+	if pipeOuts == 1 {
+		slaves = append(slaves, "[f=mpegts"+extra+"]"+pipeOut(0))
+	}
+	for _, i := range active {
+		format := pushFormat(&config.Push[i])
+		options := "f=" + format + ":onfail=ignore"
+		if format != "flv" {
+			options += extra
+		}
+		slaves = append(slaves, "["+options+"]"+ffEscape(config.Push[i].URL, "|[]"))
+	}
+	args = append(args, "-f", "tee", strings.Join(slaves, "|"))
+	return args, pipeOuts
+}
+
+// 各外部地址是否包含在本次启动中，失败的地址由重试定时器改回 pending，
+// 结果不随时间变化，比较前后生效配置时不会因为到了重试时间多重启一次。调用前需持有 t.mt
+func (t *TransformTask) pushActive(config *StreamConfig) []bool {
+	if len(config.Push) == 0 {
+		return nil
+	}
+	if t.pushStates == nil {
+		t.pushStates = make(map[string]*pushState)
+	}
+	active := make([]bool, len(config.Push))
+	for i, output := range config.Push {
+		state := t.pushStates[output.URL]
+		if state == nil {
+			state = &pushState{state: "pending"}
+			t.pushStates[output.URL] = state
+		}
+		active[i] = state.state != "failed" && state.state != "stopped"
+	}
+	return active
+}
+
+// ffmpeg 启动后本次包含的地址进入推送状态
+func (t *TransformTask) pushStarted(config *StreamConfig) {
+	t.mt.Lock()
+	defer t.mt.Unlock()
+	for _, i := range activePushOutputs(config) {
+		if state := t.pushStates[config.Push[i].URL]; state != nil {
+			state.state = "running"
+			state.since = time.Now()
+		}
+	}
+}
+
+// tee 去掉了第 slave 路，记录失败并在退避时间后重启 ffmpeg 重新加入，超过重试次数后不再加入
+func (t *TransformTask) pushFailed(config *StreamConfig, slave int, reason string) {
+	if !config.PushOnly {
+		slave-- //第 0 路为内部发布管道
+	}
+	active := activePushOutputs(config)
+	if slave < 0 || slave >= len(active) {
+		return
+	}
+	output := config.Push[active[slave]]
+	retryDelay := time.Duration(output.RetryDelay) * time.Millisecond
+	if output.RetryDelay == 0 {
+		retryDelay = 2 * time.Second
+	}
+	maxRetries := output.MaxRetries
+	if maxRetries == 0 {
+		maxRetries = pushDefaultMaxRetries
+	}
+
+	t.mt.Lock()
+	state := t.pushStates[output.URL]
+	if state == nil {
+		t.mt.Unlock()
+		return
+	}
+	if time.Since(state.since) > pushStableTime {
+		state.failures = 0
+	}
+	state.failures++
+	state.lastError = reason
+	failures := state.failures
+	if failures > maxRetries {
+		state.state = "stopped"
+		state.retryAt = time.Time{}
+		t.mt.Unlock()
+		TransformPlugin.Error("push output stopped", zap.String("url", output.URL), zap.String("error", reason),
+			zap.Int("failures", failures))
+		return
+	}
+	delay := retryDelay << (failures - 1)
+	if delay > pushMaxRetryDelay || delay <= 0 {
+		delay = pushMaxRetryDelay
+	}
+	state.state = "failed"
+	state.retryAt = time.Now().Add(delay)
+	t.mt.Unlock()
+
+	TransformPlugin.Warn("push output failed", zap.String("url", output.URL), zap.String("error", reason),
+		zap.Int("failures", failures), zap.Duration("retry", delay))
+	time.AfterFunc(delay, func() { t.pushRetry(output.URL, state) })
+}
+
+// 重试时间到，地址改回 pending 后原地重启 ffmpeg 重新加入
+func (t *TransformTask) pushRetry(url string, state *pushState) {
+	t.mt.Lock()
+	retry := !t.exit && t.pushStates[url] == state && state.state == "failed"
+	if retry {
+		state.state = "pending"
+	}
+	t.mt.Unlock()
+	if retry {
+		t.restartFF("push retry: " + url)
+	}
+}
+
+// 调用前需持有 t.mt
+func (t *TransformTask) pushStatus(config *StreamConfig) []PushStatus {
+	var status []PushStatus
+	for _, output := range config.Push {
+		s := PushStatus{URL: output.URL, State: "pending"}
+		if state := t.pushStates[output.URL]; state != nil {
+			s.State, s.Failures, s.LastError = state.state, state.failures, state.lastError
+			if state.state == "failed" {
+				s.RetryAt = state.retryAt
+			}
+		}
+		status = append(status, s)
+	}
+	return status
+}
+
+// 解析 tee 的失败日志
+func parseTeeFailure(line string) (slave int, reason string, ok bool) {
+	m := teeFailRegexp.FindStringSubmatch(line)
+	if m == nil {
+		return 0, "", false
+	}
+	slave, _ = strconv.Atoi(m[1])
+	return slave, m[2], true
+}
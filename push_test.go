@@ -0,0 +1,109 @@
+package transform
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestOutputArgs(t *testing.T) {
+	rtmp := PushOutput{URL: "rtmp://a/live/x"}
+	srt := PushOutput{URL: "srt://b:9000?streamid=a|b"}
+	tests := []struct {
+		name     string
+		config   StreamConfig
+		args     string
+		pipeOuts int
+	}{
+		{"pipe", StreamConfig{}, "-f mpegts pipe:1", 1},
+		{"pushonly waiting", StreamConfig{PushOnly: true, Push: []PushOutput{srt}, pushActive: []bool{false}}, "-f null -", 0},
+		{"tee with flv", StreamConfig{Push: []PushOutput{rtmp, srt}},
+			"-flags +global_header -f tee [f=mpegts:bsfs/v=dump_extra]pipe:1|[f=flv:onfail=ignore]rtmp://a/live/x|[f=mpegts:onfail=ignore:bsfs/v=dump_extra]srt://b:9000?streamid=a\\|b", 1},
+		{"pushonly skip failed", StreamConfig{PushOnly: true, Push: []PushOutput{rtmp, srt}, pushActive: []bool{false, true}},
+			"-f tee [f=mpegts:onfail=ignore]srt://b:9000?streamid=a\\|b", 0},
+	}
+	for _, test := range tests {
+		args, pipeOuts := outputArgs(&test.config)
+		if got := strings.Join(args, " "); got != test.args || pipeOuts != test.pipeOuts {
+			t.Errorf("%s: outputArgs = %q %d, want %q %d", test.name, got, pipeOuts, test.args, test.pipeOuts)
+		}
+	}
+}
+
+func TestParseTeeFailure(t *testing.T) {
+	slave, reason, ok := parseTeeFailure("[tee @ 0x1] Slave muxer #2 failed: Connection refused, continuing with 2/3 slaves.")
+	if !ok || slave != 2 || reason != "Connection refused" {
+		t.Errorf("parseTeeFailure = %d %q %v", slave, reason, ok)
+	}
+	if _, _, ok := parseTeeFailure("frame=10"); ok {
+		t.Error("parsed a non tee line")
+	}
+}
+
+func pushTask(config StreamConfig) *TransformTask {
+	task := &TransformTask{plugin: &TransformConfig{}, streamConfig: config, done: make(chan struct{})}
+	task.mt.Lock()
+	task.pushActive(&config)
+	task.mt.Unlock()
+	return task
+}
+
+func TestPushFailedStopsRetrying(t *testing.T) {
+	config := StreamConfig{PushOnly: true, Push: []PushOutput{{URL: "srt://b:9000", RetryDelay: 1, MaxRetries: 2}}}
+	task := pushTask(config)
+	state := task.pushStates["srt://b:9000"]
+	for i := 1; i <= 3; i++ {
+		task.pushStarted(&config)
+		task.pushFailed(&config, 0, "Connection refused")
+		want := "failed"
+		if i > 2 {
+			want = "stopped"
+		}
+		task.mt.Lock()
+		got := state.state
+		task.mt.Unlock()
+		if got != want {
+			t.Fatalf("failure %d: state = %s, want %s", i, got, want)
+		}
+		if want == "stopped" {
+			break
+		}
+		//重试定时器改回 pending
+		deadline := time.Now().Add(time.Second)
+		for {
+			task.mt.Lock()
+			got = state.state
+			task.mt.Unlock()
+			if got == "pending" || time.Now().After(deadline) {
+				break
+			}
+			time.Sleep(time.Millisecond)
+		}
+		if got != "pending" {
+			t.Fatalf("failure %d: state = %s after retry delay", i, got)
+		}
+	}
+	task.mt.Lock()
+	active := task.pushActive(&config)
+	task.mt.Unlock()
+	if active[0] {
+		t.Error("stopped output is still active")
+	}
+}
+
+// 生效配置不随重试时间变化，只由重试定时器改变
+func TestPushActiveStable(t *testing.T) {
+	config := StreamConfig{Push: []PushOutput{{URL: "rtmp://a/live/x", RetryDelay: 60000}}}
+	task := pushTask(config)
+	task.pushStarted(&config)
+	task.pushFailed(&config, 1, "Broken pipe")
+	before := task.effectiveConfig()
+	task.mt.Lock()
+	task.pushStates["rtmp://a/live/x"].retryAt = time.Now().Add(-time.Second)
+	task.mt.Unlock()
+	after := task.effectiveConfig()
+	if !reflect.DeepEqual(before.pushActive, after.pushActive) || after.pushActive[0] {
+		t.Errorf("pushActive changed after retryAt: %v -> %v", before.pushActive, after.pushActive)
+	}
+}
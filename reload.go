@@ -0,0 +1,197 @@
+package transform
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// 热加载 onstart 列表的比对结果
+type ReloadReport struct {
+	Time      time.Time `json:"time"`
+	Added     []string  `json:"added"`
+	Removed   []string  `json:"removed"`
+	Changed   []string  `json:"changed"`
+	Unchanged []string  `json:"unchanged"`
+	Kept      []string  `json:"kept"` //新配置无效，原任务保持运行
+	Errors    []string  `json:"errors"`
+}
+
+// 等待旧任务退出的最长时间，超时后放弃重启
+const reloadStopTimeout = 10 * time.Second
+
+// onstart 中一项的转码流地址，与 resolveStreamConfig 推导的一致，配置无效时也能找到对应的任务
+func onStartPath(stream *StreamConfig) string {
+	if stream.NewStreamPath != "" {
+		return stream.NewStreamPath
+	}
+	return stream.StreamPath + "-ts" + strconv.Itoa(stream.TransType)
+}
+
+// 服务启动时按 onstart 列表启动转码，记录生效的配置供热加载比对
+func (t *TransformConfig) startOnStart() {
+	applied := make(map[string]StreamConfig)
+	for _, stream := range t.OnStart {
+		stream = stream.clone()
+		if err := t.resolveStreamConfig(&stream); err != nil {
+			TransformPlugin.Error("onstart task invalid", zap.String("newStreamPath", onStartPath(&stream)), zap.Error(err))
+			continue
+		}
+		if _, err := t.setUpTransformTask(stream.clone(), true); err != nil {
+			TransformPlugin.Error("onstart task start faild", zap.String("newStreamPath", stream.NewStreamPath), zap.Error(err))
+			continue
+		}
+		applied[stream.NewStreamPath] = stream
+	}
+	t.reloadLock.Lock()
+	t.onStartApplied = applied
+	t.reloadLock.Unlock()
+}
+
+// 配置热加载后比对 onstart 列表与正在运行的任务
+// 新增的启动，删除的停止，变化的重启，未变化的不动，新配置无效的保持原任务运行
+// 只处理由 onstart 启动的转码流，API 添加的不受影响。
+// 变化与否和上次生效的 onstart 配置比较，通过 API 实时修改的文字、预置位等不会因热加载被还原
+func (t *TransformConfig) reloadOnStart() *ReloadReport {
+	report := &ReloadReport{Time: time.Now()}
+
+	want := make(map[string]StreamConfig)
+	invalid := make(map[string]bool)
+	var order []string
+	for _, stream := range t.OnStart {
+		stream = stream.clone()
+		if err := t.resolveStreamConfig(&stream); err != nil {
+			path := onStartPath(&stream)
+			report.Errors = append(report.Errors, fmt.Sprintf("%s: %v", path, err))
+			invalid[path] = true
+			continue
+		}
+		if _, ok := want[stream.NewStreamPath]; !ok {
+			order = append(order, stream.NewStreamPath)
+		}
+		want[stream.NewStreamPath] = stream
+	}
+
+	t.reloadLock.Lock()
+	previous := t.onStartApplied
+	t.reloadLock.Unlock()
+	applied := make(map[string]StreamConfig)
+
+	running := make(map[string]*TransformTask)
+	tanfsTaskLock.RLock()
+	for path, task := range tanfsTaskArray {
+		if task.isOnStartCaller(path) {
+			running[path] = task
+		}
+	}
+	tanfsTaskLock.RUnlock()
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	failed := make(map[string]error) //重启失败的转码流
+	for path, task := range running {
+		stream, ok := want[path]
+		last, known := previous[path]
+		if !known {
+			last = task.callerConfig(path)
+		}
+		switch {
+		case invalid[path]:
+			report.Kept = append(report.Kept, path)
+			if known {
+				applied[path] = last
+			}
+		case !ok:
+			report.Removed = append(report.Removed, path)
+			releaseTransform(path, "onstart removed")
+		case !reflect.DeepEqual(stream, last):
+			report.Changed = append(report.Changed, path)
+			applied[path] = stream
+			wg.Add(1)
+			go func(path string, stream StreamConfig) {
+				defer wg.Done()
+				if err := t.restartOnStartTask(path, stream); err != nil {
+					mu.Lock()
+					failed[path] = err
+					mu.Unlock()
+				}
+			}(path, stream)
+		default:
+			report.Unchanged = append(report.Unchanged, path)
+			applied[path] = stream
+		}
+	}
+
+	for _, path := range order {
+		if running[path] != nil {
+			continue
+		}
+		if _, err := t.setUpTransformTask(want[path].clone(), true); err != nil {
+			report.Errors = append(report.Errors, fmt.Sprintf("%s: %v", path, err))
+			continue
+		}
+		report.Added = append(report.Added, path)
+		applied[path] = want[path]
+	}
+	//等待重启完成，失败的也计入比对结果
+	wg.Wait()
+	for path, err := range failed {
+		report.Errors = append(report.Errors, fmt.Sprintf("%s: %v", path, err))
+		delete(applied, path)
+	}
+
+	for _, list := range [][]string{report.Added, report.Removed, report.Changed, report.Unchanged, report.Kept} {
+		sort.Strings(list)
+	}
+	TransformPlugin.Info("transform reload onstart",
+		zap.Strings("added", report.Added),
+		zap.Strings("removed", report.Removed),
+		zap.Strings("changed", report.Changed),
+		zap.Strings("unchanged", report.Unchanged),
+		zap.Strings("kept", report.Kept),
+		zap.Strings("errors", report.Errors))
+
+	t.reloadLock.Lock()
+	t.lastReload = report
+	t.onStartApplied = applied
+	t.reloadLock.Unlock()
+	return report
+}
+
+// 释放旧的转码流，任务因此结束时等待其退出，再按新配置重新启动
+func (t *TransformConfig) restartOnStartTask(path string, stream StreamConfig) error {
+	task := releaseTransform(path, "onstart changed")
+	if task != nil && task.exiting() {
+		select {
+		case <-task.done:
+		case <-time.After(reloadStopTimeout):
+			TransformPlugin.Error("onstart task stop timeout", zap.String("newStreamPath", stream.NewStreamPath))
+			return fmt.Errorf("old task did not stop within %v", reloadStopTimeout)
+		}
+	}
+	if _, err := t.setUpTransformTask(stream.clone(), true); err != nil {
+		TransformPlugin.Error("onstart task restart faild", zap.String("newStreamPath", stream.NewStreamPath), zap.Error(err))
+		return err
+	}
+	return nil
+}
+
+// /transform/reload 返回最近一次热加载的比对结果，还没有热加载过时返回 404
+func (t *TransformConfig) Reload(w http.ResponseWriter, r *http.Request) {
+	t.reloadLock.Lock()
+	report := t.lastReload
+	t.reloadLock.Unlock()
+	if report == nil {
+		http.Error(w, "onstart has not been reloaded", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
@@ -0,0 +1,162 @@
+package transform
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// 分辨率表达式
+//
+//	720*576       固定尺寸
+//	-2*480        高为 480，宽按源宽高比推导，-1 不要求偶数，源比目标小时不放大
+//	max:1280*720  保持宽高比缩放到框内，不放大
+//	keep          保持源尺寸
+type resolution struct {
+	Keep bool
+	Max  bool
+	W, H int //-1 -2 表示按宽高比推导
+}
+
+func parseResolution(s string) (res resolution, err error) {
+	if s == "keep" {
+		return resolution{Keep: true}, nil
+	}
+	max := strings.HasPrefix(s, "max:")
+	size := strings.TrimPrefix(s, "max:")
+	w, h, ok := strings.Cut(strings.Replace(size, "x", "*", 1), "*")
+	if ok {
+		res.W, err = strconv.Atoi(w)
+	}
+	if ok && err == nil {
+		res.H, err = strconv.Atoi(h)
+	}
+	if !ok || err != nil {
+		return res, fmt.Errorf("invalid resolution: %s", s)
+	}
+	res.Max = max
+	switch {
+	case res.W > 0 && res.H > 0:
+	case !max && res.W > 0 && (res.H == -1 || res.H == -2):
+	case !max && res.H > 0 && (res.W == -1 || res.W == -2):
+	default:
+		return res, fmt.Errorf("invalid resolution: %s", s)
+	}
+	return res, nil
+}
+
+// 固定宽高，可以加黑边
+func (r resolution) boxed() bool {
+	return !r.Keep && r.W > 0 && r.H > 0
+}
+
+// 生成缩放滤镜，pad 为 true 时保持宽高比缩放后加黑边补足到目标尺寸
+// 源尺寸在 ffmpeg 中以 iw ih 求值，不需要事先知道
+func (r resolution) scaleFilters(g *filterGraph, pad bool) []string {
+	if r.Keep {
+		return nil
+	}
+	notUp := func(in string, size int) string {
+		if size < 0 {
+			return strconv.Itoa(size)
+		}
+		return filterValue(fmt.Sprintf("min(%s,%d)", in, size))
+	}
+
+	var scale []string
+	switch {
+	case r.Max:
+		scale = []string{"w=" + notUp("iw", r.W), "h=" + notUp("ih", r.H),
+			"force_original_aspect_ratio=decrease", "force_divisible_by=2"}
+	case r.W < 0 || r.H < 0:
+		scale = []string{"w=" + notUp("iw", r.W), "h=" + notUp("ih", r.H)}
+	case pad:
+		scale = []string{fmt.Sprintf("w=%d", r.W), fmt.Sprintf("h=%d", r.H),
+			"force_original_aspect_ratio=decrease", "force_divisible_by=2"}
+	default:
+		scale = []string{fmt.Sprintf("w=%d", r.W), fmt.Sprintf("h=%d", r.H)}
+	}
+	filters := []string{g.F("scale", scale...)}
+	if pad && r.boxed() {
+		filters = append(filters, g.F("pad", fmt.Sprintf("w=%d", r.W), fmt.Sprintf("h=%d", r.H),
+			"x="+filterValue("(ow-iw)/2"), "y="+filterValue("(oh-ih)/2")))
+	}
+	return filters
+}
+
+// 目标尺寸超过源尺寸，多码率阶梯中跳过这一档
+func (r resolution) exceeds(source SourceInfo) bool {
+	switch {
+	case r.Keep:
+		return false
+	case r.Max:
+		//max 不会放大，框比源大时输出与源相同
+		return r.W > source.Width && r.H > source.Height
+	case r.W < 0:
+		return r.H > source.Height
+	case r.H < 0:
+		return r.W > source.Width
+	default:
+		return r.W > source.Width || r.H > source.Height
+	}
+}
+
+// 按源尺寸换算输出尺寸，与 scaleFilters 在 ffmpeg 中的结果一致
+func (r resolution) size(source SourceInfo) (w, h int) {
+	sw, sh := float64(source.Width), float64(source.Height)
+	//-2 与 max: 取偶数
+	round := func(v float64, mode int) int {
+		if mode == -1 {
+			return int(math.Round(v))
+		}
+		return int(math.Round(v/2)) * 2
+	}
+	switch {
+	case r.Keep:
+		return source.Width, source.Height
+	case r.Max:
+		scale := math.Min(math.Min(float64(r.W)/sw, float64(r.H)/sh), 1)
+		return round(sw*scale, -2), round(sh*scale, -2)
+	case r.W < 0:
+		h = r.H
+		if h > source.Height {
+			h = source.Height
+		}
+		return round(sw*float64(h)/sh, r.W), h
+	case r.H < 0:
+		w = r.W
+		if w > source.Width {
+			w = source.Width
+		}
+		return w, round(sh*float64(w)/sw, r.H)
+	}
+	return r.W, r.H
+}
+
+// 预览校验滤镜图时合成画面的尺寸
+func (r resolution) testSize() string {
+	if r.boxed() {
+		return fmt.Sprintf("%dx%d", r.W, r.H)
+	}
+	return "1280x720"
+}
+
+// 去掉超过源尺寸的档位，全部超过时保留最后一档
+func ladderRenditions(renditions []Rendition, source SourceInfo) []Rendition {
+	if source.Width == 0 {
+		return renditions
+	}
+	var kept []Rendition
+	for _, r := range renditions {
+		res, err := parseResolution(r.Resolution)
+		if err == nil && res.exceeds(source) {
+			continue
+		}
+		kept = append(kept, r)
+	}
+	if len(kept) == 0 && len(renditions) > 0 {
+		kept = renditions[len(renditions)-1:]
+	}
+	return kept
+}
@@ -0,0 +1,71 @@
+package transform
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseResolution(t *testing.T) {
+	tests := []struct {
+		s    string
+		want resolution
+		err  bool
+	}{
+		{"720*576", resolution{W: 720, H: 576}, false},
+		{"1280x720", resolution{W: 1280, H: 720}, false},
+		{"max:1280*720", resolution{Max: true, W: 1280, H: 720}, false},
+		{"-2*480", resolution{W: -2, H: 480}, false},
+		{"640*-1", resolution{W: 640, H: -1}, false},
+		{"keep", resolution{Keep: true}, false},
+		{"max:-2*480", resolution{}, true},
+		{"-2*-2", resolution{}, true},
+		{"0*480", resolution{}, true},
+		{"720", resolution{}, true},
+		{"a*b", resolution{}, true},
+	}
+	for _, test := range tests {
+		got, err := parseResolution(test.s)
+		if (err != nil) != test.err || (!test.err && got != test.want) {
+			t.Errorf("parseResolution(%q) = %+v %v", test.s, got, err)
+		}
+	}
+}
+
+func TestScaleFilters(t *testing.T) {
+	tests := []struct {
+		s    string
+		pad  bool
+		want string
+	}{
+		{"720*576", false, "scale=w=720:h=576"},
+		{"720*576", true, "scale=w=720:h=576:force_original_aspect_ratio=decrease:force_divisible_by=2,pad=w=720:h=576:x=(ow-iw)/2:y=(oh-ih)/2"},
+		{"max:1280*720", false, `scale=w=min(iw\,1280):h=min(ih\,720):force_original_aspect_ratio=decrease:force_divisible_by=2`},
+		{"-2*480", true, `scale=w=-2:h=min(ih\,480)`},
+		{"640*-1", false, `scale=w=min(iw\,640):h=-1`},
+		{"keep", true, ""},
+	}
+	for _, test := range tests {
+		res, _ := parseResolution(test.s)
+		if got := strings.Join(res.scaleFilters(newFilterGraph("0:v"), test.pad), ","); got != test.want {
+			t.Errorf("scaleFilters(%q, %v) = %s, want %s", test.s, test.pad, got, test.want)
+		}
+	}
+}
+
+func TestResolutionExceeds(t *testing.T) {
+	source := SourceInfo{Width: 1280, Height: 720}
+	for s, want := range map[string]bool{
+		"1920*1080":     true,
+		"1280*720":      false,
+		"max:1920*1080": true,
+		"max:1920*480":  false,
+		"-2*1080":       true,
+		"640*-2":        false,
+		"keep":          false,
+	} {
+		res, _ := parseResolution(s)
+		if got := res.exceeds(source); got != want {
+			t.Errorf("%s exceeds %v = %v", s, source, got)
+		}
+	}
+}
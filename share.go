@@ -0,0 +1,180 @@
+package transform
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+// 相同的转码请求共用一个任务：后来的请求作为调用者加入，
+// ffmpeg 的输出同时发布到每个调用者的转码流地址，所有调用者都停止后任务才结束
+
+// 去掉转码流地址后的配置，相同即可共用
+func shareKey(config *StreamConfig) string {
+	c := *config
+	c.NewStreamPath = ""
+	key, _ := json.Marshal(&c)
+	return string(key)
+}
+
+// 查找配置相同的任务，调用前需持有 tanfsTaskLock
+// 直接推流的任务没有发布地址，数字云台的画面由调用者控制，都不共用；推流地址重复由 checkPushConflict 拒绝
+func findSharedTask(config *StreamConfig) *TransformTask {
+	if len(outputStreamPaths(config)) == 0 || config.TransType == TransTypePtz {
+		return nil
+	}
+	key := shareKey(config)
+	for _, task := range tanfsTaskArray {
+		if task.exiting() {
+			continue
+		}
+		c := task.config()
+		if shareKey(&c) == key {
+			return task
+		}
+	}
+	return nil
+}
+
+// 外部推流地址已被其他任务使用，两个进程推同一地址会互相顶掉
+var errPushConflict = errors.New("push target is used by another task")
+
+// 检查外部推流地址是否已被 self 以外正在运行的任务使用，调用前需持有 tanfsTaskLock
+func checkPushConflict(config *StreamConfig, self *TransformTask) error {
+	urls := make(map[string]bool, len(config.Push))
+	for _, push := range config.Push {
+		urls[push.URL] = true
+	}
+	if len(urls) == 0 {
+		return nil
+	}
+	for path, task := range tanfsTaskArray {
+		if task == self || task.exiting() {
+			continue
+		}
+		c := task.config()
+		for _, push := range c.Push {
+			if urls[push.URL] {
+				return fmt.Errorf("%w: %s by %s", errPushConflict, push.URL, path)
+			}
+		}
+	}
+	return nil
+}
+
+// 配置错误返回 400，与其他任务冲突返回 409
+func setUpStatus(err error) int {
+	if errors.Is(err, errPushConflict) {
+		return http.StatusConflict
+	}
+	return http.StatusBadRequest
+}
+
+func (t *TransformTask) addCaller(path string, fromOnStart bool) {
+	t.mt.Lock()
+	t.callers[path] = fromOnStart
+	t.mt.Unlock()
+}
+
+// 共用本任务的转码流地址
+func (t *TransformTask) callerPaths() []string {
+	t.mt.Lock()
+	paths := make([]string, 0, len(t.callers))
+	for path := range t.callers {
+		paths = append(paths, path)
+	}
+	t.mt.Unlock()
+	sort.Strings(paths)
+	return paths
+}
+
+// 由 onstart 启动的调用者
+func (t *TransformTask) isOnStartCaller(path string) bool {
+	t.mt.Lock()
+	defer t.mt.Unlock()
+	return t.callers[path]
+}
+
+// 以调用者的转码流地址看到的配置
+func (t *TransformTask) callerConfig(path string) StreamConfig {
+	config := t.config()
+	config.NewStreamPath = path
+	return config
+}
+
+// 按 newstreampath 查找任务，不存在时返回 404，task 为 nil
+func lookupTask(w http.ResponseWriter, r *http.Request) (task *TransformTask, newStreamPath string) {
+	newStreamPath = r.URL.Query().Get("newstreampath")
+	tanfsTaskLock.RLock()
+	task = tanfsTaskArray[newStreamPath]
+	tanfsTaskLock.RUnlock()
+	if task == nil {
+		http.Error(w, "task not found: "+newStreamPath, http.StatusNotFound)
+	}
+	return
+}
+
+// 共用的任务修改配置会影响其他调用者，返回 409
+func taskOwned(w http.ResponseWriter, task *TransformTask) bool {
+	if callers := task.callerPaths(); len(callers) > 1 {
+		http.Error(w, "task is shared by "+strings.Join(callers, ","), http.StatusConflict)
+		return false
+	}
+	return true
+}
+
+// 查找将要修改的任务，不存在返回 404，被共用返回 409，task 为 nil
+func lookupOwnedTask(w http.ResponseWriter, r *http.Request) (task *TransformTask, newStreamPath string) {
+	task, newStreamPath = lookupTask(w, r)
+	if task == nil || !taskOwned(w, task) {
+		return nil, newStreamPath
+	}
+	return task, newStreamPath
+}
+
+// 释放一个调用者，删除其发布的转码流，没有调用者时结束任务
+func releaseTransform(path string, reason string) *TransformTask {
+	tanfsTaskLock.Lock()
+	task := tanfsTaskArray[path]
+	if task == nil {
+		tanfsTaskLock.Unlock()
+		return nil
+	}
+	delete(tanfsTaskArray, path)
+	task.mt.Lock()
+	delete(task.callers, path)
+	remaining := make([]string, 0, len(task.callers))
+	for caller := range task.callers {
+		remaining = append(remaining, caller)
+	}
+	//任务以剩下的调用者继续运行
+	if len(remaining) > 0 && task.streamConfig.NewStreamPath == path {
+		sort.Strings(remaining)
+		task.streamConfig.NewStreamPath = remaining[0]
+	}
+	task.mt.Unlock()
+	tanfsTaskLock.Unlock()
+
+	if len(remaining) == 0 {
+		task.stop(reason)
+	} else {
+		TransformPlugin.Info("release transform caller", zap.String("newStreamPath", path), zap.Strings("callers", remaining))
+		task.syncPublishers()
+	}
+	return task
+}
+
+// /transform/stop?newstreampath=xxx 停止转码流，与其他请求共用时只删除自己的转码流
+func (t *TransformConfig) Stop(w http.ResponseWriter, r *http.Request) {
+	newStreamPath := r.URL.Query().Get("newstreampath")
+	if releaseTransform(newStreamPath, "api stop") == nil {
+		http.Error(w, "task not found: "+newStreamPath, http.StatusNotFound)
+		return
+	}
+	w.Write([]byte("ok"))
+}
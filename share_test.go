@@ -0,0 +1,151 @@
+package transform
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// 直接登记一个不运行的任务，调用者为 paths
+func registerTask(t *testing.T, config StreamConfig, paths ...string) *TransformTask {
+	task := &TransformTask{plugin: &TransformConfig{}, streamConfig: config, callers: make(map[string]bool), done: make(chan struct{})}
+	tanfsTaskLock.Lock()
+	for _, path := range paths {
+		task.callers[path] = false
+		tanfsTaskArray[path] = task
+	}
+	tanfsTaskLock.Unlock()
+	t.Cleanup(func() {
+		tanfsTaskLock.Lock()
+		for _, path := range paths {
+			delete(tanfsTaskArray, path)
+		}
+		tanfsTaskLock.Unlock()
+	})
+	return task
+}
+
+func TestLookupOwnedTask(t *testing.T) {
+	registerTask(t, StreamConfig{NewStreamPath: "test/own"}, "test/own")
+	registerTask(t, StreamConfig{NewStreamPath: "test/a", File: &FileConfig{Path: "demo.ts"}}, "test/a", "test/b")
+	conf := &TransformConfig{}
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+		shared  bool //修改共用的任务返回 409
+	}{
+		{"osd", conf.Osd, true},
+		{"ticker", conf.Ticker, true},
+		{"update", conf.Update, true},
+		{"masks", conf.Masks, true},
+		{"seek", conf.Seek, true},
+		{"mosaic", conf.Mosaic, false}, //共用的任务不是拼接，先返回 400
+		{"ptz", conf.Ptz, false},
+	}
+	for _, test := range tests {
+		want := map[string]int{"test/none": http.StatusNotFound}
+		if test.shared {
+			want["test/b"] = http.StatusConflict
+		}
+		for path, code := range want {
+			rec := httptest.NewRecorder()
+			url := "/transform/" + test.name + "?newstreampath=" + path + "&offset=1&swap=0,1"
+			test.handler(rec, httptest.NewRequest(http.MethodPost, url, nil))
+			if rec.Code != code {
+				t.Errorf("%s %s: status %d, want %d", test.name, path, rec.Code, code)
+			}
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	task, path := lookupOwnedTask(rec, httptest.NewRequest(http.MethodGet, "/transform/osd?newstreampath=test/own", nil))
+	if task == nil || path != "test/own" || rec.Code != http.StatusOK {
+		t.Errorf("lookupOwnedTask = %v %q %d", task, path, rec.Code)
+	}
+}
+
+// 循环播放本地文件，seek 后以新的起始位置原地重启
+func TestSeekRestartsFile(t *testing.T) {
+	conf, starts := fakeBackend(t)
+	if err := os.WriteFile(filepath.Join(conf.Path, "demo.ts"), []byte{0x47}, 0644); err != nil {
+		t.Fatal(err)
+	}
+	config := StreamConfig{
+		TransType:     TransTypeFile,
+		NewStreamPath: "test/file",
+		File:          &FileConfig{Path: "demo.ts"},
+		Push:          []PushOutput{{URL: "udp://127.0.0.1:1234"}},
+		PushOnly:      true,
+	}
+	task, err := conf.setUpTransformTask(config, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		releaseTransform("test/file", "test")
+		waitDone(t, task)
+	}()
+	waitStart(t, starts)
+
+	rec := httptest.NewRecorder()
+	conf.Seek(rec, httptest.NewRequest(http.MethodGet, "/transform/seek?newstreampath=test/file&offset=90", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("seek: %d %s", rec.Code, rec.Body)
+	}
+	if f := waitStart(t, starts); f.config.File.Offset != 90 {
+		t.Errorf("restarted with offset %v", f.config.File.Offset)
+	}
+
+	rec = httptest.NewRecorder()
+	conf.Seek(rec, httptest.NewRequest(http.MethodGet, "/transform/seek?newstreampath=test/file&offset=-1", nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("negative offset: %d", rec.Code)
+	}
+}
+
+// 直接推流的任务不共用，推到同一外部地址的请求返回 409，先前的任务结束后才能再推
+func TestPushConflict(t *testing.T) {
+	conf, starts := fakeBackend(t)
+	task, err := conf.setUpTransformTask(pullConfig("test/push-a"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitStart(t, starts)
+	_, err = conf.setUpTransformTask(pullConfig("test/push-b"), false)
+	if !errors.Is(err, errPushConflict) || setUpStatus(err) != http.StatusConflict {
+		t.Errorf("second push to the same target: %v", err)
+	}
+	if registeredTask("test/push-b") != nil {
+		t.Error("conflicting task registered")
+	}
+
+	other := pullConfig("test/push-c")
+	other.Push = []PushOutput{{URL: "udp://127.0.0.1:1235"}}
+	taskC, err := conf.setUpTransformTask(other, false)
+	if err != nil {
+		t.Fatalf("different push target: %v", err)
+	}
+	waitStart(t, starts)
+	rec := httptest.NewRecorder()
+	push := url.QueryEscape(`[{"url":"udp://127.0.0.1:1234"}]`)
+	conf.Update(rec, httptest.NewRequest(http.MethodPost, "/transform/update?newstreampath=test/push-c&push="+push, nil))
+	if rec.Code != http.StatusConflict {
+		t.Errorf("update to a used push target: status %d %s", rec.Code, rec.Body)
+	}
+
+	releaseTransform("test/push-a", "test")
+	waitDone(t, task)
+	taskB, err := conf.setUpTransformTask(pullConfig("test/push-b"), false)
+	if err != nil {
+		t.Fatalf("push after the previous task ended: %v", err)
+	}
+	waitStart(t, starts)
+	for path, task := range map[string]*TransformTask{"test/push-b": taskB, "test/push-c": taskC} {
+		releaseTransform(path, "test")
+		waitDone(t, task)
+	}
+}
@@ -0,0 +1,105 @@
+package transform
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+)
+
+// 垫片：源中断时 ffmpeg 原地重启为垫片命令，继续按输出尺寸和帧率发布静态图片或信号中断画面，
+// 源恢复后再原地重启回正常转码，转码流地址不中断
+type SlateConfig struct {
+	Image string `yaml:"image" json:"image"` //静态图片，相对路径基于 TransformConfig.Path，为空时生成信号中断画面
+	Text  string `yaml:"text" json:"text"`   //画面上的文字，支持文字层的变量，默认 SIGNAL LOST
+	Color string `yaml:"color" json:"color"` //生成画面的底色，默认 0x202020
+}
+
+func defaultSlateConfig(config *StreamConfig) {
+	slate := config.Slate
+	if slate == nil {
+		return
+	}
+	if slate.Text == "" && slate.Image == "" {
+		slate.Text = "SIGNAL LOST"
+	}
+	if slate.Color == "" {
+		slate.Color = "0x202020"
+	}
+}
+
+func validateSlate(config *StreamConfig) error {
+	if config.Slate == nil {
+		return nil
+	}
+	switch config.TransType {
+	case TransTypePipe, TransTypePtz, TransTypePip:
+	default:
+		return fmt.Errorf("slate is not supported by transtype %d", config.TransType)
+	}
+	//垫片按输出尺寸生成
+	res, _ := parseResolution(config.Resolution)
+	if !res.boxed() {
+		return errors.New("slate requires a w*h or max:w*h resolution")
+	}
+	if _, err := expandText(config.Slate.Text, config); err != nil {
+		return err
+	}
+	return nil
+}
+
+// 任务启动前检查垫片图片存在
+func (t *TransformConfig) checkSlate(config *StreamConfig) error {
+	if config.Slate == nil || config.Slate.Image == "" {
+		return nil
+	}
+	path := t.logoPath(config.Slate.Image)
+	if info, err := os.Stat(path); err != nil {
+		return fmt.Errorf("slate image %s: %w", path, err)
+	} else if info.IsDir() {
+		return fmt.Errorf("slate image %s is a directory", path)
+	}
+	return nil
+}
+
+// 源中断时的命令，文字下方显示当前时间，编码参数与正常转码相同
+func (t *TransformConfig) slateCommand(config *StreamConfig) *ffmpegCommand {
+	slate := config.Slate
+	res, _ := parseResolution(config.Resolution)
+	var args []string
+	var g *filterGraph
+	if slate.Image != "" {
+		args = append(globalArgs(), "-loop", "1", "-framerate", config.Fps, "-re", "-i", t.logoPath(slate.Image))
+		g = newFilterGraph("0:v")
+		g.Filter("scale", fmt.Sprintf("w=%d", res.W), fmt.Sprintf("h=%d", res.H), "force_original_aspect_ratio=decrease")
+		g.Filter("pad", fmt.Sprintf("w=%d", res.W), fmt.Sprintf("h=%d", res.H), "x=(ow-iw)/2", "y=(oh-ih)/2", "color="+filterValue(slate.Color))
+		g.Filter("setsar", "1")
+		g.Filter("format", "yuv420p")
+	} else {
+		//只有 color 源，realtime 限制为实时速度
+		args = globalArgs()
+		g = newFilterGraph("")
+		bg := g.Label("bg")
+		g.Chain(nil, []string{bg},
+			g.F("color", "c="+filterValue(slate.Color), fmt.Sprintf("s=%dx%d", res.W, res.H), "r="+config.Fps),
+			g.F("realtime"),
+		)
+		g.Continue(bg)
+	}
+	fontsize := res.H / 12
+	if slate.Text != "" {
+		text, _ := expandText(slate.Text, config)
+		g.Filter("drawtext", drawtextRawArgs(t.Fontfile, fontsize, drawtextText(text),
+			"(w-text_w)/2", "(h-text_h)/2", "white", "")...)
+	}
+	timeText, _ := expandText("{time}", config)
+	g.Filter("drawtext", drawtextRawArgs(t.Fontfile, fontsize/2, drawtextText(timeText),
+		"(w-text_w)/2", "h/2+"+strconv.Itoa(fontsize), "white", "")...)
+	g.Output("vout")
+
+	args = append(args, "-filter_complex", g.String(), "-map", "[vout]")
+	args = append(args, videoEncodeArgs(config)...)
+	outArgs, pipeOuts := outputArgs(config)
+	args = append(args, outArgs...)
+	return &ffmpegCommand{Args: args, Filter: g, FilterOutputs: []string{"vout"}, PipeOuts: pipeOuts}
+}
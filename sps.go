@@ -0,0 +1,213 @@
+package transform
+
+import (
+	"errors"
+)
+
+// 源流的画面信息，由 SPS 解析得到
+type SourceInfo struct {
+	Width  int     `json:"width"`
+	Height int     `json:"height"`
+	Fps    float64 `json:"fps,omitempty"` //SPS 中没有 timing info 时为 0
+}
+
+var errSPSTruncated = errors.New("sps truncated")
+
+// 按位读取 SPS，读越界时记录错误
+type bitReader struct {
+	data []byte
+	pos  int
+	err  error
+}
+
+func (r *bitReader) bit() uint {
+	if r.pos >= len(r.data)*8 {
+		r.err = errSPSTruncated
+		return 0
+	}
+	b := r.data[r.pos/8] >> (7 - r.pos%8) & 1
+	r.pos++
+	return uint(b)
+}
+
+func (r *bitReader) bits(n int) uint {
+	var v uint
+	for i := 0; i < n; i++ {
+		v = v<<1 | r.bit()
+	}
+	return v
+}
+
+// 无符号指数哥伦布编码
+func (r *bitReader) ue() uint {
+	zeros := 0
+	for r.bit() == 0 && r.err == nil {
+		zeros++
+		if zeros > 31 {
+			r.err = errors.New("invalid exp-golomb code")
+			return 0
+		}
+	}
+	return 1<<zeros - 1 + r.bits(zeros)
+}
+
+// 有符号指数哥伦布编码
+func (r *bitReader) se() int {
+	v := r.ue()
+	if v&1 == 1 {
+		return int(v+1) / 2
+	}
+	return -int(v / 2)
+}
+
+// 去掉防竞争字节 00 00 03
+func unescapeRBSP(nal []byte) []byte {
+	rbsp := make([]byte, 0, len(nal))
+	zeros := 0
+	for _, b := range nal {
+		if zeros >= 2 && b == 3 {
+			zeros = 0
+			continue
+		}
+		if b == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+		rbsp = append(rbsp, b)
+	}
+	return rbsp
+}
+
+// 跳过 scaling_list
+func skipScalingList(r *bitReader, size int) {
+	last, next := 8, 8
+	for i := 0; i < size; i++ {
+		if next != 0 {
+			next = (last + r.se() + 256) % 256
+		}
+		if next != 0 {
+			last = next
+		}
+	}
+}
+
+// 解析 H.264 SPS 得到宽高和帧率，nal 不含起始码
+func parseSPS(nal []byte) (info SourceInfo, err error) {
+	if len(nal) < 4 || nal[0]&0x1f != 7 {
+		return info, errors.New("not a sps nal")
+	}
+	r := &bitReader{data: unescapeRBSP(nal[1:])}
+	profile := r.bits(8)
+	r.bits(16) //constraint_set_flags level_idc
+	r.ue()     //seq_parameter_set_id
+
+	chromaFormat := uint(1)
+	separateColourPlane := uint(0)
+	switch profile {
+	case 100, 110, 122, 244, 44, 83, 86, 118, 128, 138, 139, 134, 135:
+		chromaFormat = r.ue()
+		if chromaFormat == 3 {
+			separateColourPlane = r.bit()
+		}
+		r.ue()  //bit_depth_luma_minus8
+		r.ue()  //bit_depth_chroma_minus8
+		r.bit() //qpprime_y_zero_transform_bypass_flag
+		if r.bit() == 1 {
+			n := 8
+			if chromaFormat == 3 {
+				n = 12
+			}
+			for i := 0; i < n; i++ {
+				if r.bit() == 1 {
+					if i < 6 {
+						skipScalingList(r, 16)
+					} else {
+						skipScalingList(r, 64)
+					}
+				}
+			}
+		}
+	}
+
+	r.ue() //log2_max_frame_num_minus4
+	switch r.ue() {
+	case 0:
+		r.ue() //log2_max_pic_order_cnt_lsb_minus4
+	case 1:
+		r.bit() //delta_pic_order_always_zero_flag
+		r.se()  //offset_for_non_ref_pic
+		r.se()  //offset_for_top_to_bottom_field
+		n := r.ue()
+		if n > 255 {
+			return info, errors.New("invalid num_ref_frames_in_pic_order_cnt_cycle")
+		}
+		for i := uint(0); i < n; i++ {
+			r.se()
+		}
+	}
+	r.ue()  //max_num_ref_frames
+	r.bit() //gaps_in_frame_num_value_allowed_flag
+	widthMbs := r.ue() + 1
+	heightMapUnits := r.ue() + 1
+	frameMbsOnly := r.bit()
+	if frameMbsOnly == 0 {
+		r.bit() //mb_adaptive_frame_field_flag
+	}
+	r.bit() //direct_8x8_inference_flag
+
+	var cropLeft, cropRight, cropTop, cropBottom uint
+	if r.bit() == 1 {
+		cropLeft, cropRight, cropTop, cropBottom = r.ue(), r.ue(), r.ue(), r.ue()
+	}
+
+	//裁剪单位与色度采样格式有关
+	cropUnitX, cropUnitY := uint(1), 2-frameMbsOnly
+	if separateColourPlane == 0 && chromaFormat != 0 {
+		if chromaFormat == 1 || chromaFormat == 2 {
+			cropUnitX = 2
+		}
+		if chromaFormat == 1 {
+			cropUnitY *= 2
+		}
+	}
+	if r.err != nil {
+		return info, r.err
+	}
+	info.Width = int(widthMbs*16) - int((cropLeft+cropRight)*cropUnitX)
+	info.Height = int((2-frameMbsOnly)*heightMapUnits*16) - int((cropTop+cropBottom)*cropUnitY)
+	if info.Width <= 0 || info.Height <= 0 {
+		return SourceInfo{}, errors.New("invalid sps size")
+	}
+
+	//vui_parameters 中的 timing_info
+	if r.bit() == 1 {
+		if r.bit() == 1 { //aspect_ratio_info_present_flag
+			if r.bits(8) == 255 {
+				r.bits(32) //sar_width sar_height
+			}
+		}
+		if r.bit() == 1 { //overscan_info_present_flag
+			r.bit()
+		}
+		if r.bit() == 1 { //video_signal_type_present_flag
+			r.bits(4)
+			if r.bit() == 1 {
+				r.bits(24)
+			}
+		}
+		if r.bit() == 1 { //chroma_loc_info_present_flag
+			r.ue()
+			r.ue()
+		}
+		if r.bit() == 1 { //timing_info_present_flag
+			numUnitsInTick := r.bits(32)
+			timeScale := r.bits(32)
+			//VUI 截断时只返回宽高
+			if numUnitsInTick > 0 && r.err == nil {
+				info.Fps = float64(timeScale) / float64(2*numUnitsInTick)
+			}
+		}
+	}
+	return info, nil
+}
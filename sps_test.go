@@ -0,0 +1,29 @@
+package transform
+
+import (
+	"encoding/hex"
+	"errors"
+	"testing"
+)
+
+func TestParseSPS(t *testing.T) {
+	tests := []struct {
+		sps  string
+		want SourceInfo
+	}{
+		{"6764001fac2ca4014016ec04400000fa000030d43800001e848000186a02ef2e0fa489", SourceInfo{Width: 1280, Height: 720, Fps: 25}},
+		//1088 行编码，frame cropping 裁到 1080
+		{"67640028acd940780227e5c04400000fa40003a983c60c6580", SourceInfo{Width: 1920, Height: 1080, Fps: 30000.0 / 1001}},
+		{"674d401fe8802802dd80b501010140000003004000000c83c60c4480", SourceInfo{Width: 1280, Height: 720, Fps: 25}},
+	}
+	for _, test := range tests {
+		nal, _ := hex.DecodeString(test.sps)
+		got, err := parseSPS(nal)
+		if err != nil || got.Width != test.want.Width || got.Height != test.want.Height || int(got.Fps*100) != int(test.want.Fps*100) {
+			t.Errorf("parseSPS(%s) = %+v %v, want %+v", test.sps[:10], got, err, test.want)
+		}
+		if _, err := parseSPS(nal[:4]); !errors.Is(err, errSPSTruncated) {
+			t.Errorf("truncated %s: %v", test.sps[:10], err)
+		}
+	}
+}
@@ -0,0 +1,40 @@
+package transform
+
+import (
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// 转码进度停止超过 StallTimeout 视为 ffmpeg 卡死，原地重启，订阅者和发布者保持不变
+// 进度停止期间管道输入也没有新数据时是源断流，不重启；没有进度输出的引擎（gst-launch）不检测
+func (t *TransformTask) watchStall(transcoder Transcoder, pipeIn bool, done <-chan struct{}) {
+	timeout := t.plugin.StallTimeout
+	if timeout <= 0 {
+		return
+	}
+	ticker := time.NewTicker(timeout / 4)
+	defer ticker.Stop()
+	var last time.Time                //最近一次进度更新时间
+	lastInBytes := t.counts().inBytes //进度更新时已写入的数据量
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+		progress := transcoder.Progress()
+		inBytes := t.counts().inBytes
+		if progress.Frame == 0 || !progress.Time.Equal(last) {
+			last = progress.Time
+			lastInBytes = inBytes
+			continue
+		}
+		if time.Since(last) < timeout || pipeIn && inBytes == lastInBytes {
+			continue
+		}
+		TransformPlugin.Warn("ffmpeg stalled", zap.Duration("since", time.Since(last)), zap.Int("inBytes", inBytes-lastInBytes))
+		t.restartFF("ffmpeg stalled")
+		return
+	}
+}
@@ -0,0 +1,94 @@
+package transform
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// 任务状态
+type TaskStatus struct {
+	NewStreamPath  string             `json:"newStreamPath"`
+	StreamPath     string             `json:"streamPath"`
+	TransType      int                `json:"transType"`
+	Status         int                `json:"status"`
+	StartTime      time.Time          `json:"startTime"`
+	RestartFFCount int                `json:"restartFFCount"`
+	RePullCount    int                `json:"rePullCount"` //拉取外部地址断流后重连的次数
+	InBytes        int                `json:"inBytes"`
+	Callers        []string           `json:"callers"` //共用本任务的转码流地址
+	Source         *SourceInfo        `json:"source,omitempty"`
+	Ptz            *PtzPosition       `json:"ptz,omitempty"` //数字云台当前位置
+	Stabilize      *StabilizeStatus   `json:"stabilize,omitempty"`
+	Inputs         []InputStatus      `json:"inputs,omitempty"`       //主输入之外的订阅输入，配置了垫片时第一路为源流
+	Slate          bool               `json:"slate"`                  //源中断，正在输出垫片
+	ActiveSource   string             `json:"activeSource,omitempty"` //配置了备用源时正在使用的源流
+	Outputs        []string           `json:"outputs"`                //发布的转码流地址
+	Push           []PushStatus       `json:"push,omitempty"`         //各外部地址的推送状态
+	Progress       *TranscodeProgress `json:"progress,omitempty"`
+	Config         StreamConfig       `json:"config"`
+}
+
+func (t *TransformTask) Status() TaskStatus {
+	config := t.config()
+	counts := t.counts()
+	status := TaskStatus{
+		NewStreamPath:  config.NewStreamPath,
+		StreamPath:     config.StreamPath,
+		TransType:      config.TransType,
+		Status:         counts.status,
+		StartTime:      t.atTime,
+		RestartFFCount: counts.restartFFCount,
+		RePullCount:    counts.rePullCount,
+		InBytes:        counts.inBytes,
+		Callers:        t.callerPaths(),
+		Config:         config,
+	}
+	t.mt.Lock()
+	transcoder := t.transcoder
+	if t.ptz != nil {
+		pos := t.ptz.position()
+		status.Ptz = &pos
+	}
+	if t.source.Width > 0 {
+		source := t.source
+		status.Source = &source
+	}
+	status.Inputs = t.inputStatus()
+	status.Slate = config.Slate != nil && t.sourceDown()
+	status.Push = t.pushStatus(&config)
+	if len(t.sourceInputs) > 0 {
+		status.ActiveSource = t.sourceInputs[t.activeSource].streamPath
+	}
+	for _, paths := range t.outputPaths {
+		status.Outputs = append(status.Outputs, paths...)
+	}
+	t.mt.Unlock()
+	status.Stabilize = stabilizeStatus(&config, transcoder != nil)
+	if transcoder != nil {
+		progress := transcoder.Progress()
+		status.Progress = &progress
+	}
+	return status
+}
+
+// /transform/list 返回所有任务的状态
+func (t *TransformConfig) List(w http.ResponseWriter, r *http.Request) {
+	var list []TaskStatus
+	listed := make(map[*TransformTask]bool)
+	tanfsTaskLock.RLock()
+	for _, task := range tanfsTaskArray {
+		//共用的任务只列一次
+		if !listed[task] {
+			listed[task] = true
+			list = append(list, task.Status())
+		}
+	}
+	tanfsTaskLock.RUnlock()
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].NewStreamPath < list[j].NewStreamPath
+	})
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
@@ -4,6 +4,7 @@ import (
 	"encoding/hex"
 	"fmt"
 	"log"
+	"net"
 
 	"go.uber.org/zap"
 	. "m7s.live/engine/v4"
@@ -13,11 +14,12 @@ import (
 
 type TransformSubscriber struct {
 	Subscriber
-	task *TransformTask
+	task  *TransformTask
+	input *extraInput //附加输入的订阅者，主输入为 nil
 }
 
 func (s *TransformSubscriber) Delete() {
-	s.Stop(zap.String("reason", "for restart"))
+	taskEngine.Unsubscribe(s, "for restart")
 }
 
 func sliceAppend(s1 []byte, s2 []byte) []byte {
@@ -62,16 +64,46 @@ func (s *TransformSubscriber) OnEvent(event any) {
 			//2023/04/02 17:07:51 pipe in SPS:35, [6764001fac2ca4014016ec04400000fa000030d43800001e848000186a02ef2e0fa489]
 			//2023/04/02 17:07:51 pipe in PPS:4, [68eb8f2c]
 			nal := []byte{0, 0, 0, 1}
+			//附加输入只缓存 SPS PPS，垫片时订阅的源流还要更新源尺寸
+			if s.input != nil {
+				if s.input.main && len(v.ParamaterSets[0]) > 0 {
+					if source, err := parseSPS(v.ParamaterSets[0]); err == nil {
+						s.input.setSourceInfo(source)
+					}
+				}
+				var paramSets [][]byte
+				for _, ps := range v.ParamaterSets[:2] {
+					if len(ps) > 0 {
+						paramSets = append(paramSets, append(nal, ps...))
+					}
+				}
+				s.input.setParamSets(paramSets)
+				break
+			}
+			var paramSets [][]byte
 			//SPS
 			if len(v.ParamaterSets[0]) > 0 {
 				//vt.WriteSliceBytes(v.ParamaterSets[0])
-
-				t.writeToFFPipe0(append(nal, v.ParamaterSets[0]...))
+				if source, err := parseSPS(v.ParamaterSets[0]); err != nil {
+					TransformPlugin.Warn("parse sps failed", zap.Error(err))
+				} else {
+					log.Printf("source size:%dx%d fps:%.2f\n", source.Width, source.Height, source.Fps)
+					t.setSource(source)
+				}
+
+				paramSets = append(paramSets, append(nal, v.ParamaterSets[0]...))
 			}
 			//PPS:
 			if len(v.ParamaterSets[1]) > 0 {
 				//vt.WriteSliceBytes(v.ParamaterSets[1])
-				t.writeToFFPipe0(append(nal, v.ParamaterSets[1]...))
+				paramSets = append(paramSets, append(nal, v.ParamaterSets[1]...))
+			}
+			//ffmpeg 原地重启后需要补发
+			t.mt.Lock()
+			t.paramSets = paramSets
+			t.mt.Unlock()
+			for _, buf := range paramSets {
+				t.writeToFFPipe0(buf)
 			}
 		case codec.CodecID_H265:
 			fmt.Println("=====> CodecID_H265 on  sub")
@@ -93,7 +125,8 @@ func (s *TransformSubscriber) OnEvent(event any) {
 		}
 		s.AddTrack(v)
 	case *track.Audio:
-		if s.Audio != nil {
+		//附加输入只取画面
+		if s.Audio != nil || s.input != nil {
 			return
 		}
 		fmt.Println("=====>  write *track.Audio to  publisher")
@@ -104,14 +137,7 @@ func (s *TransformSubscriber) OnEvent(event any) {
 		firstFrame := v.GetAnnexB()
 		// log.Printf("pipe in PTS:%d,DTS:%d buf num:%d\n",
 		// 	v.PTS, v.DTS, len(firstFrame))
-
-		for _, buf := range firstFrame {
-			// log.Printf("pipe in PTS:%d,DTS:%d buf len:%d,\n",
-			// 	v.PTS, v.DTS, len(buf))
-			//s.debugPrintfNal(buf, "on sub frame")
-			//p.VideoTrack.WriteAnnexB(v.PTS, v.DTS, buf)
-			t.writeToFFPipe0(buf)
-		}
+		s.writeAnnexB(firstFrame)
 	case VideoRTP:
 		fmt.Println("=====>  on subscribe VideoRTP")
 		//p.WritePacketRTP(s.videoTrack, v.Packet)
@@ -129,3 +155,16 @@ func (s *TransformSubscriber) OnEvent(event any) {
 		//fmt.Println("TransformSubscriber OnEvent:%T", v)
 	}
 }
+
+// 一帧 annexb 格式的 nalu 写入 ffmpeg 的输入管道
+func (s *TransformSubscriber) writeAnnexB(frame net.Buffers) {
+	for _, buf := range frame {
+		//s.debugPrintfNal(buf, "on sub frame")
+		//p.VideoTrack.WriteAnnexB(v.PTS, v.DTS, buf)
+		if s.input != nil {
+			s.input.write(buf)
+			continue
+		}
+		s.task.writeToFFPipe0(buf)
+	}
+}
@@ -0,0 +1,209 @@
+package transform
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// 文字叠加层，text 中可以使用变量，运行时由 drawtext 展开
+//
+//	{time}         本地时间，默认格式 %Y-%m-%d %H:%M:%S
+//	{time:%H:%M}   本地时间，strftime 格式
+//	{stream}       源流地址
+//	{resolution}   输出分辨率 eg:1280x720
+//	{frame}        帧序号
+//	{pts}          源时间戳，秒；{pts:hms} 为时:分:秒
+//	{{ }}          字面的大括号
+type TextLayer struct {
+	Text      string `yaml:"text"`
+	Anchor    string `yaml:"anchor"` //同台标，默认 topleft
+	X         int    `yaml:"x"`
+	Y         int    `yaml:"y"`
+	Fontfile  string `yaml:"fontfile"` //为空时使用插件配置的 fontfile
+	Fontsize  int    `yaml:"fontsize"` //默认 24
+	FontColor string `yaml:"fontcolor"`
+	BoxColor  string `yaml:"boxcolor"` //为空时不加背景框
+}
+
+// 锚点 → drawtext 的 x y 表达式，w h 为画面尺寸，text_w text_h 为文字尺寸
+var textAnchors = map[string][2]string{
+	"topleft":     {"%d", "%d"},
+	"topright":    {"w-text_w-%d", "%d"},
+	"bottomleft":  {"%d", "h-text_h-%d"},
+	"bottomright": {"w-text_w-%d", "h-text_h-%d"},
+	"center":      {"(w-text_w)/2+%d", "(h-text_h)/2+%d"},
+}
+
+const defaultTimeFormat = "%Y-%m-%d %H:%M:%S"
+
+// 把带变量的文字转成 drawtext 的 text，字面部分按 drawtext 的规则转义
+func expandText(text string, config *StreamConfig) (string, error) {
+	var b strings.Builder
+	for len(text) > 0 {
+		i := strings.IndexAny(text, "{}")
+		if i < 0 {
+			b.WriteString(ffEscape(text, "%"))
+			break
+		}
+		b.WriteString(ffEscape(text[:i], "%"))
+		if strings.HasPrefix(text[i:], "{{") || strings.HasPrefix(text[i:], "}}") {
+			b.WriteByte(text[i])
+			text = text[i+2:]
+			continue
+		}
+		end := strings.IndexByte(text[i:], '}')
+		if text[i] == '}' || end < 0 {
+			return "", fmt.Errorf("unbalanced brace in text: %s", text)
+		}
+		name, arg, hasArg := strings.Cut(text[i+1:i+end], ":")
+		//%{} 函数的参数以 : 分隔，参数中的 : } ' 需要转义
+		escArg := ffEscape(arg, ":}'")
+		switch {
+		case name == "time" && !hasArg:
+			b.WriteString("%{localtime:" + ffEscape(defaultTimeFormat, ":}'") + "}")
+		case name == "time":
+			b.WriteString("%{localtime:" + escArg + "}")
+		case name == "stream" && !hasArg:
+			b.WriteString(ffEscape(config.StreamPath, "%"))
+		case name == "resolution" && !hasArg:
+			b.WriteString("%{eif:w:d}x%{eif:h:d}")
+		case name == "frame" && !hasArg:
+			b.WriteString("%{n}")
+		case name == "pts" && !hasArg:
+			b.WriteString("%{pts}")
+		case name == "pts":
+			b.WriteString("%{pts:" + escArg + "}")
+		default:
+			return "", fmt.Errorf("unknown text variable: {%s}", text[i+1:i+end])
+		}
+		text = text[i+end+1:]
+	}
+	return b.String(), nil
+}
+
+// [{"text":"{stream} {time}","anchor":"bottomleft","fontsize":24}]
+func parseTextLayers(s string) ([]TextLayer, error) {
+	var layers []TextLayer
+	if err := json.Unmarshal([]byte(s), &layers); err != nil {
+		return nil, fmt.Errorf("invalid texts: %w", err)
+	}
+	return layers, nil
+}
+
+func validateTextLayer(layer *TextLayer, config *StreamConfig) error {
+	if _, ok := textAnchors[layer.Anchor]; layer.Anchor != "" && !ok {
+		return fmt.Errorf("invalid text anchor: %s", layer.Anchor)
+	}
+	if layer.Fontsize < 0 {
+		return fmt.Errorf("invalid text fontsize: %d", layer.Fontsize)
+	}
+	_, err := expandText(layer.Text, config)
+	return err
+}
+
+// 文字叠加层的 drawtext 滤镜，在缩放之后使用，{resolution} 为输出分辨率
+func (t *TransformConfig) textFilters(g *filterGraph, config *StreamConfig) []string {
+	var filters []string
+	for _, layer := range config.TextLayers {
+		text, err := expandText(layer.Text, config)
+		if err != nil || text == "" {
+			continue
+		}
+		anchor, ok := textAnchors[layer.Anchor]
+		if !ok {
+			anchor = textAnchors["topleft"]
+		}
+		fontfile := layer.Fontfile
+		if fontfile == "" {
+			fontfile = t.Fontfile
+		}
+		fontsize := layer.Fontsize
+		if fontsize == 0 {
+			fontsize = 24
+		}
+		fontcolor := layer.FontColor
+		if fontcolor == "" {
+			fontcolor = "white"
+		}
+		filters = append(filters, g.F("drawtext", drawtextRawArgs(fontfile, fontsize, drawtextText(text),
+			fmt.Sprintf(anchor[0], layer.X), fmt.Sprintf(anchor[1], layer.Y), fontcolor, layer.BoxColor)...))
+	}
+	return filters
+}
+
+// 滚动字幕：底部或顶部的背景条上文字从右向左循环滚动，文字从文件读取，可通过 /transform/ticker 实时修改
+type Ticker struct {
+	Text      string `yaml:"text"`
+	Speed     int    `yaml:"speed"`    //滚动速度，像素每秒，默认 100
+	Position  string `yaml:"position"` //bottom（默认） top
+	Height    int    `yaml:"height"`   //背景条高度，默认为字号的 1.6 倍
+	Fontfile  string `yaml:"fontfile"` //为空时使用插件配置的 fontfile
+	Fontsize  int    `yaml:"fontsize"` //默认 32
+	FontColor string `yaml:"fontcolor"`
+	BandColor string `yaml:"bandcolor"` //背景条颜色，默认 black@0.6
+}
+
+// {"text":"暴雨预警","speed":120,"position":"bottom"}
+func parseTicker(s string) (*Ticker, error) {
+	var ticker Ticker
+	if err := json.Unmarshal([]byte(s), &ticker); err != nil {
+		return nil, fmt.Errorf("invalid ticker: %w", err)
+	}
+	return &ticker, nil
+}
+
+func validateTicker(ticker *Ticker) error {
+	if ticker.Position != "" && ticker.Position != "bottom" && ticker.Position != "top" {
+		return fmt.Errorf("invalid ticker position: %s", ticker.Position)
+	}
+	if ticker.Speed < 0 || ticker.Height < 0 || ticker.Fontsize < 0 {
+		return fmt.Errorf("ticker speed, height and fontsize must not be negative")
+	}
+	return nil
+}
+
+// 背景条 drawbox 加滚动的 drawtext，在缩放之后使用
+func (t *TransformConfig) tickerFilters(g *filterGraph, config *StreamConfig) []string {
+	ticker := config.Ticker
+	if ticker == nil {
+		return nil
+	}
+	speed := ticker.Speed
+	if speed == 0 {
+		speed = 100
+	}
+	fontsize := ticker.Fontsize
+	if fontsize == 0 {
+		fontsize = 32
+	}
+	height := ticker.Height
+	if height == 0 {
+		height = fontsize * 8 / 5
+	}
+	fontfile := ticker.Fontfile
+	if fontfile == "" {
+		fontfile = t.Fontfile
+	}
+	fontcolor := ticker.FontColor
+	if fontcolor == "" {
+		fontcolor = "white"
+	}
+	bandcolor := ticker.BandColor
+	if bandcolor == "" {
+		bandcolor = "black@0.6"
+	}
+	top := fmt.Sprintf("ih-%d", height)
+	if ticker.Position == "top" {
+		top = "0"
+	}
+	return []string{
+		g.F("drawbox", "x=0", "y="+filterValue(top), "w=iw", fmt.Sprintf("h=%d", height),
+			"color="+filterValue(bandcolor), "t=fill"),
+		//文字从右边进入，完全移出左边后重新开始
+		g.F("drawtext", drawtextRawArgs(fontfile, fontsize, drawtextFile(t.tickerFile(config)),
+			fmt.Sprintf("w-mod(t*%d,w+text_w)", speed),
+			fmt.Sprintf("%s+(%d-text_h)/2", strings.Replace(top, "ih", "h", 1), height),
+			fontcolor, "")...),
+	}
+}
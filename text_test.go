@@ -0,0 +1,42 @@
+package transform
+
+import "testing"
+
+func TestFilterValue(t *testing.T) {
+	tests := map[string]string{
+		"min(iw,1280)": `min(iw\,1280)`,
+		"12:30":        `12\\:30`,
+		"it's":         `it\\\'s`,
+		"[a];b":        `\[a\]\;b`,
+		`c:\font.ttf`:  `c\\:\\\\font.ttf`,
+	}
+	for s, want := range tests {
+		if got := filterValue(s); got != want {
+			t.Errorf("filterValue(%q) = %q, want %q", s, got, want)
+		}
+	}
+}
+
+func TestExpandText(t *testing.T) {
+	config := &StreamConfig{StreamPath: "live/a"}
+	tests := []struct {
+		text string
+		want string
+		err  bool
+	}{
+		{"{stream} {time}", `live/a %{localtime:%Y-%m-%d %H\:%M\:%S}`, false},
+		{"{time:%H:%M}", `%{localtime:%H\:%M}`, false},
+		{"100% {{x}}", `100\% {x}`, false},
+		{"{frame}/{resolution}", "%{n}/%{eif:w:d}x%{eif:h:d}", false},
+		{"{pts} {pts:hms}", "%{pts} %{pts:hms}", false},
+		{"{bad}", "", true},
+		{"{open", "", true},
+		{"close}", "", true},
+	}
+	for _, test := range tests {
+		got, err := expandText(test.text, config)
+		if (err != nil) != test.err || got != test.want {
+			t.Errorf("expandText(%q) = %q %v, want %q", test.text, got, err, test.want)
+		}
+	}
+}
@@ -0,0 +1,69 @@
+package transform
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// 转码引擎，任务只通过它启动和结束转码进程
+// ffmpeg 进程为默认实现
+type Transcoder interface {
+	// 生成将要执行的命令，不启动
+	Argv(config *StreamConfig) ([]string, error)
+	// 按配置启动转码
+	Start(config *StreamConfig) error
+	// 订阅裸流的写入端，第一路为主输入，输入不是管道时为 nil，其余为附加输入
+	Inputs() []io.WriteCloser
+	// 转码后各路 ts 流的读取端，直接推流时为空，调用者读到结束后关闭
+	Outputs() []io.ReadCloser
+	// 最近一次的转码进度
+	Progress() TranscodeProgress
+	// 等待转码结束
+	Wait() error
+	// 结束转码，先让进程写完封装尾部正常退出，超时后强制结束，Wait 随后返回
+	Stop() error
+}
+
+// 转码进度
+type TranscodeProgress struct {
+	Frame   int64     `json:"frame"`
+	Fps     string    `json:"fps"`
+	Bitrate string    `json:"bitrate"`
+	OutTime string    `json:"outTime"`
+	Speed   string    `json:"speed"`
+	Time    time.Time `json:"time"` //最近一次更新时间
+}
+
+// 转码引擎名称 → 创建方法，测试时可以注册不启动进程的实现
+var transcoderBackends = map[string]func(t *TransformConfig) Transcoder{
+	"":          func(t *TransformConfig) Transcoder { return &ffmpegTranscoder{plugin: t} },
+	"ffmpeg":    func(t *TransformConfig) Transcoder { return &ffmpegTranscoder{plugin: t} },
+	"gstreamer": func(t *TransformConfig) Transcoder { return &gstTranscoder{plugin: t} },
+}
+
+func (t *TransformConfig) newTranscoder() (Transcoder, error) {
+	if backend, ok := transcoderBackends[t.Backend]; ok {
+		return backend(t), nil
+	}
+	return nil, fmt.Errorf("unknown transcoder backend: %s", t.Backend)
+}
+
+// 转码进程收到结束信号后等待其退出的最长时间
+const transcoderStopTimeout = 3 * time.Second
+
+// 先发信号让进程自行结束，exited 关闭前超时则强制结束；不支持信号的系统（windows）直接结束
+func stopProcess(p *os.Process, sig os.Signal, exited <-chan struct{}) error {
+	if err := p.Signal(sig); err != nil {
+		return p.Kill()
+	}
+	go func() {
+		select {
+		case <-exited:
+		case <-time.After(transcoderStopTimeout):
+			p.Kill()
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,243 @@
+package transform
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"sync"
+	"testing"
+	"time"
+)
+
+// 不启动进程的转码引擎，Wait 在 Stop 或 exit 后返回
+type fakeTranscoder struct {
+	starts chan<- *fakeTranscoder
+
+	config   StreamConfig
+	outs     []io.ReadCloser
+	writers  []*io.PipeWriter //各路输出的写入端，模拟 ffmpeg 输出
+	stopped  bool
+	progress TranscodeProgress
+
+	once sync.Once
+	done chan struct{}
+	err  error
+}
+
+func (f *fakeTranscoder) Argv(config *StreamConfig) ([]string, error) {
+	return []string{"fake", config.NewStreamPath}, nil
+}
+
+func (f *fakeTranscoder) Start(config *StreamConfig) error {
+	f.config = *config
+	f.done = make(chan struct{})
+	for range outputStreamPaths(config) {
+		r, w := io.Pipe()
+		f.outs = append(f.outs, r)
+		f.writers = append(f.writers, w)
+	}
+	f.starts <- f
+	return nil
+}
+
+func (f *fakeTranscoder) Inputs() []io.WriteCloser {
+	return []io.WriteCloser{nil}
+}
+
+func (f *fakeTranscoder) Outputs() []io.ReadCloser {
+	return f.outs
+}
+
+func (f *fakeTranscoder) Progress() TranscodeProgress {
+	return f.progress
+}
+
+func (f *fakeTranscoder) Wait() error {
+	<-f.done
+	for _, w := range f.writers {
+		w.Close()
+	}
+	return f.err
+}
+
+func (f *fakeTranscoder) Stop() error {
+	f.stopped = true
+	f.exit(nil)
+	return nil
+}
+
+// 模拟转码进程自行退出
+func (f *fakeTranscoder) exit(err error) {
+	f.once.Do(func() {
+		f.err = err
+		close(f.done)
+	})
+}
+
+// 注册 fake 引擎，返回每次启动的转码
+func fakeBackend(t *testing.T) (*TransformConfig, <-chan *fakeTranscoder) {
+	starts := make(chan *fakeTranscoder, 16)
+	transcoderBackends["fake"] = func(*TransformConfig) Transcoder {
+		return &fakeTranscoder{starts: starts}
+	}
+	t.Cleanup(func() { delete(transcoderBackends, "fake") })
+	return &TransformConfig{Backend: "fake", Path: t.TempDir()}, starts
+}
+
+func waitStart(t *testing.T, starts <-chan *fakeTranscoder) *fakeTranscoder {
+	t.Helper()
+	select {
+	case f := <-starts:
+		return f
+	case <-time.After(3 * time.Second):
+		t.Fatal("transcoder not started")
+		return nil
+	}
+}
+
+func waitDone(t *testing.T, task *TransformTask) {
+	t.Helper()
+	select {
+	case <-task.done:
+	case <-time.After(3 * time.Second):
+		t.Fatal("task not ended")
+	}
+}
+
+// 只推送的拉流任务，不订阅也不发布，run 的生命周期不依赖引擎
+func pullConfig(path string) StreamConfig {
+	return StreamConfig{
+		TransType:     TransTypePull,
+		NewStreamPath: path,
+		Pull:          &PullConfig{URL: "srt://127.0.0.1:9000", ReconnectDelay: 10},
+		Push:          []PushOutput{{URL: "udp://127.0.0.1:1234"}},
+		PushOnly:      true,
+	}
+}
+
+func TestRunRestartInPlace(t *testing.T) {
+	conf, starts := fakeBackend(t)
+	task, err := conf.setUpTransformTask(pullConfig("test/restart"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := waitStart(t, starts)
+	if first.config.textID != task.id {
+		t.Errorf("textID = %q, want %q", first.config.textID, task.id)
+	}
+	if counts := task.counts(); counts.restartFFCount != 1 {
+		t.Errorf("restartFFCount = %d, want 1", counts.restartFFCount)
+	}
+
+	task.restartFF("test")
+	waitStart(t, starts)
+	if !first.stopped {
+		t.Error("restartFF did not stop the running transcoder")
+	}
+	if counts := task.counts(); counts.restartFFCount != 2 || counts.rePullCount != 0 {
+		t.Errorf("restartFFCount = %d rePullCount = %d, want 2 0", counts.restartFFCount, counts.rePullCount)
+	}
+
+	releaseTransform("test/restart", "test")
+	waitDone(t, task)
+}
+
+func TestRunPullReconnect(t *testing.T) {
+	conf, starts := fakeBackend(t)
+	task, err := conf.setUpTransformTask(pullConfig("test/reconnect"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := waitStart(t, starts)
+	//拉流断开后等待 reconnectdelay 重新拉取
+	f.exit(errors.New("exit status 1"))
+	waitStart(t, starts)
+	if counts := task.counts(); counts.restartFFCount != 2 || counts.rePullCount != 1 {
+		t.Errorf("restartFFCount = %d rePullCount = %d, want 2 1", counts.restartFFCount, counts.rePullCount)
+	}
+
+	releaseTransform("test/reconnect", "test")
+	waitDone(t, task)
+}
+
+func TestRunStopEndsTask(t *testing.T) {
+	conf, starts := fakeBackend(t)
+	task, err := conf.setUpTransformTask(pullConfig("test/stop"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := waitStart(t, starts)
+
+	if task := releaseTransform("test/stop", "test"); task == nil {
+		t.Fatal("task not found")
+	}
+	waitDone(t, task)
+	if !f.stopped {
+		t.Error("transcoder not stopped")
+	}
+	if task.exitReason != "test" {
+		t.Errorf("exitReason = %q", task.exitReason)
+	}
+	tanfsTaskLock.RLock()
+	defer tanfsTaskLock.RUnlock()
+	if tanfsTaskArray["test/stop"] != nil {
+		t.Error("task still registered")
+	}
+	select {
+	case <-starts:
+		t.Error("transcoder restarted after stop")
+	default:
+	}
+}
+
+// 多码率阶梯的每一路输出复制给每个调用者对应档位的发布者，调用者释放后其发布者关闭
+func TestRunPublishesOutputs(t *testing.T) {
+	conf, starts := fakeBackend(t)
+	engine := useFakeEngine(t)
+	config := StreamConfig{
+		StreamPath:    "live/ladder",
+		NewStreamPath: "test/ladder",
+		TransType:     TransTypeLadder,
+		Renditions:    []Rendition{{Name: "720", Resolution: "1280*720"}, {Name: "360", Resolution: "640*360"}},
+	}
+	task, err := conf.setUpTransformTask(config, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := waitStart(t, starts)
+	config.NewStreamPath = "test/ladder-b"
+	if shared, err := conf.setUpTransformTask(config, false); err != nil || shared != task {
+		t.Fatalf("identical ladder not shared: %v", err)
+	}
+	if len(f.writers) != 2 {
+		t.Fatalf("%d outputs, want 2", len(f.writers))
+	}
+
+	for i, name := range []string{"720", "360"} {
+		data := bytes.Repeat([]byte(name), 188)
+		if _, err := f.writers[i].Write(data); err != nil {
+			t.Fatal(err)
+		}
+		for _, caller := range []string{"test/ladder", "test/ladder-b"} {
+			path := caller + "/" + name
+			waitFor(t, path+" published", func() bool { return bytes.Equal(engine.received(path), data) })
+		}
+	}
+	if counts := task.counts(); counts.outBytes != 188*6 {
+		t.Errorf("outBytes = %d, want %d", counts.outBytes, 188*6)
+	}
+
+	releaseTransform("test/ladder-b", "test")
+	for _, name := range []string{"720", "360"} {
+		if engine.live("test/ladder-b/"+name) || !engine.live("test/ladder/"+name) {
+			t.Errorf("rendition %s: released caller still published or remaining caller unpublished", name)
+		}
+		waitFor(t, "released publisher closed", func() bool { return engine.closed("test/ladder-b/" + name) })
+	}
+
+	releaseTransform("test/ladder", "test")
+	waitDone(t, task)
+	for _, name := range []string{"720", "360"} {
+		waitFor(t, "publisher closed", func() bool { return engine.closed("test/ladder/" + name) })
+	}
+}
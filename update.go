@@ -0,0 +1,68 @@
+package transform
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+)
+
+// 任务参数更新前后的配置
+type UpdateResult struct {
+	Before StreamConfig `json:"before"`
+	After  StreamConfig `json:"after"`
+}
+
+// /transform/update?newstreampath=xxx&osdtext=xxx&bitrate=xxx
+// 修改运行中任务的参数，只重启 ffmpeg 进程，转码流地址和发布者保持不变
+func (t *TransformConfig) Update(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPatch && r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	task, newStreamPath := lookupOwnedTask(w, r)
+	if task == nil {
+		return
+	}
+
+	before := task.callerConfig(newStreamPath)
+	after := before.clone()
+	if err := parseStreamConfig(r.URL.Query(), &after); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := checkStreamConfigUpdate(&before, &after); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := t.resolveStreamConfig(&after); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	tanfsTaskLock.RLock()
+	err := checkPushConflict(&after, task)
+	tanfsTaskLock.RUnlock()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+
+	task.update(after)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(UpdateResult{Before: before, After: after})
+}
+
+// 原地更新不能改变输入输出和转码类型
+func checkStreamConfigUpdate(before, after *StreamConfig) error {
+	if after.TransType != before.TransType {
+		return errors.New("transtype can not be updated")
+	}
+	if after.StreamPath != before.StreamPath {
+		return errors.New("streampath can not be updated")
+	}
+	if after.NewStreamPath != before.NewStreamPath {
+		return errors.New("newstreampath can not be updated")
+	}
+	return nil
+}
@@ -0,0 +1,165 @@
+package transform
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ffmpeg zmq 滤镜的 REQ 客户端，只实现 ZMTP 3.0 NULL 机制下的一问一答
+type zmqReq struct {
+	addr string //tcp://127.0.0.1:5555
+
+	mu   sync.Mutex
+	conn net.Conn
+	rd   *bufio.Reader
+}
+
+const zmqTimeout = 3 * time.Second
+
+// 发送一条消息并等待应答，连接断开（ffmpeg 重启）时重连一次
+func (z *zmqReq) Request(msg string) (string, error) {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	var err error
+	for retry := 0; retry < 2; retry++ {
+		if z.conn == nil {
+			if err = z.connect(); err != nil {
+				continue
+			}
+		}
+		var reply string
+		z.conn.SetDeadline(time.Now().Add(zmqTimeout))
+		if err = z.send([]byte(msg)); err == nil {
+			if reply, err = z.recv(); err == nil {
+				return reply, nil
+			}
+		}
+		z.closeConn()
+	}
+	return "", err
+}
+
+func (z *zmqReq) Close() {
+	z.mu.Lock()
+	z.closeConn()
+	z.mu.Unlock()
+}
+
+func (z *zmqReq) closeConn() {
+	if z.conn != nil {
+		z.conn.Close()
+		z.conn = nil
+	}
+}
+
+func (z *zmqReq) connect() error {
+	conn, err := net.DialTimeout("tcp", strings.TrimPrefix(z.addr, "tcp://"), zmqTimeout)
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Now().Add(zmqTimeout))
+	z.conn, z.rd = conn, bufio.NewReader(conn)
+
+	//问候：签名、版本 3.0、NULL 机制、客户端
+	greeting := make([]byte, 64)
+	greeting[0], greeting[9] = 0xff, 0x7f
+	greeting[10] = 3
+	copy(greeting[12:32], "NULL")
+	if _, err = conn.Write(greeting); err == nil {
+		_, err = io.ReadFull(z.rd, greeting)
+	}
+	if err == nil && (greeting[0] != 0xff || greeting[9]&1 != 1 || greeting[10] < 3) {
+		err = errors.New("invalid zmtp greeting")
+	}
+
+	//交换 READY 命令
+	if err == nil {
+		var ready bytes.Buffer
+		ready.WriteString("\x05READY")
+		ready.WriteString("\x0bSocket-Type")
+		binary.Write(&ready, binary.BigEndian, uint32(3))
+		ready.WriteString("REQ")
+		err = z.writeFrame(0x04, ready.Bytes())
+	}
+	if err == nil {
+		var flags byte
+		var body []byte
+		flags, body, err = z.readFrame()
+		if err == nil && (flags&0x04 == 0 || !bytes.HasPrefix(body, []byte("\x05READY"))) {
+			err = errors.New("zmtp peer not ready")
+		}
+	}
+	if err != nil {
+		z.closeConn()
+	}
+	return err
+}
+
+// REQ 消息前有一个空的分隔帧
+func (z *zmqReq) send(msg []byte) error {
+	if err := z.writeFrame(0x01, nil); err != nil {
+		return err
+	}
+	return z.writeFrame(0x00, msg)
+}
+
+// 读到没有 MORE 标志的帧为止，跳过分隔帧
+func (z *zmqReq) recv() (string, error) {
+	var reply bytes.Buffer
+	for {
+		flags, body, err := z.readFrame()
+		if err != nil {
+			return "", err
+		}
+		if flags&0x04 != 0 {
+			continue
+		}
+		reply.Write(body)
+		if flags&0x01 == 0 {
+			return reply.String(), nil
+		}
+	}
+}
+
+func (z *zmqReq) writeFrame(flags byte, body []byte) error {
+	var frame []byte
+	if len(body) > 255 {
+		frame = append([]byte{flags | 0x02}, make([]byte, 8)...)
+		binary.BigEndian.PutUint64(frame[1:], uint64(len(body)))
+	} else {
+		frame = []byte{flags, byte(len(body))}
+	}
+	_, err := z.conn.Write(append(frame, body...))
+	return err
+}
+
+func (z *zmqReq) readFrame() (flags byte, body []byte, err error) {
+	if flags, err = z.rd.ReadByte(); err != nil {
+		return
+	}
+	var size uint64
+	if flags&0x02 != 0 {
+		err = binary.Read(z.rd, binary.BigEndian, &size)
+	} else {
+		var b byte
+		b, err = z.rd.ReadByte()
+		size = uint64(b)
+	}
+	if err != nil {
+		return
+	}
+	if size > 1<<20 {
+		return flags, nil, fmt.Errorf("zmtp frame too large: %d", size)
+	}
+	body = make([]byte, size)
+	_, err = io.ReadFull(z.rd, body)
+	return
+}
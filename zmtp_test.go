@@ -0,0 +1,136 @@
+package transform
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// 回环的 ffmpeg zmq 滤镜，应答 "0 Success <消息长度>"，每个连接处理 perConn 条消息后断开
+func zmqServer(t *testing.T, perConn int) (addr string, received <-chan string) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	msgs := make(chan string, 16)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go serveZmq(t, conn, perConn, msgs)
+		}
+	}()
+	return "tcp://" + ln.Addr().String(), msgs
+}
+
+func serveZmq(t *testing.T, conn net.Conn, perConn int, msgs chan<- string) {
+	defer conn.Close()
+	z := &zmqReq{conn: conn, rd: bufio.NewReader(conn)}
+	greeting := make([]byte, 64)
+	if _, err := io.ReadFull(z.rd, greeting); err != nil {
+		return
+	}
+	if greeting[0] != 0xff || greeting[9] != 0x7f || greeting[10] != 3 || !bytes.HasPrefix(greeting[12:], []byte("NULL\x00")) {
+		t.Errorf("client greeting % x", greeting[:16])
+		return
+	}
+	greeting[11] = 0
+	conn.Write(greeting)
+	if flags, body, err := z.readFrame(); err != nil || flags != 0x04 || !bytes.Contains(body, []byte("Socket-Type\x00\x00\x00\x03REQ")) {
+		t.Errorf("client ready %x %q %v", flags, body, err)
+		return
+	}
+	z.writeFrame(0x04, []byte("\x05READY\x0bSocket-Type\x00\x00\x00\x03REP"))
+	for i := 0; i < perConn; i++ {
+		//空分隔帧带 MORE，随后是消息帧
+		if flags, body, err := z.readFrame(); err != nil || flags != 0x01 || len(body) != 0 {
+			return
+		}
+		flags, body, err := z.readFrame()
+		if err != nil || flags&0x01 != 0 {
+			return
+		}
+		msgs <- string(body)
+		z.writeFrame(0x01, nil)
+		z.writeFrame(0x00, []byte("0 Success "+strconv.Itoa(len(body))))
+	}
+}
+
+func TestZmqRequest(t *testing.T) {
+	addr, received := zmqServer(t, 2)
+	z := &zmqReq{addr: addr}
+	defer z.Close()
+	long := "Parsed_crop_1 x " + strings.Repeat("9", 300) //超过 255 字节用 8 字节长度
+	//第三条消息时服务端已断开，重连一次后成功
+	for _, msg := range []string{"Parsed_crop_1 w 640", long, "Parsed_crop_1 y 20"} {
+		reply, err := z.Request(msg)
+		if err != nil {
+			t.Fatalf("Request(%.20s): %v", msg, err)
+		}
+		if want := "0 Success " + strconv.Itoa(len(msg)); reply != want {
+			t.Errorf("reply = %q, want %q", reply, want)
+		}
+		if got := <-received; got != msg {
+			t.Errorf("server received %.20q, want %.20q", got, msg)
+		}
+	}
+}
+
+func TestZmqRequestRefused(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+	if _, err := (&zmqReq{addr: "tcp://" + addr}).Request("x"); err == nil {
+		t.Error("request to a closed port succeeded")
+	}
+}
+
+func TestZmtpFrames(t *testing.T) {
+	tests := []struct {
+		flags  byte
+		body   []byte
+		header []byte
+	}{
+		{0x01, nil, []byte{0x01, 0}},
+		{0x00, []byte("abc"), []byte{0x00, 3}},
+		{0x04, bytes.Repeat([]byte{1}, 255), []byte{0x04, 255}},
+		{0x00, bytes.Repeat([]byte{1}, 256), []byte{0x02, 0, 0, 0, 0, 0, 0, 1, 0}},
+	}
+	for _, test := range tests {
+		var buf bytes.Buffer
+		w := &zmqReq{conn: &bufConn{buf: &buf}}
+		if err := w.writeFrame(test.flags, test.body); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.HasPrefix(buf.Bytes(), test.header) || buf.Len() != len(test.header)+len(test.body) {
+			t.Errorf("frame %x/%d header % x", test.flags, len(test.body), buf.Bytes()[:len(test.header)])
+		}
+		r := &zmqReq{rd: bufio.NewReader(&buf)}
+		flags, body, err := r.readFrame()
+		if err != nil || flags != test.header[0] || !bytes.Equal(body, test.body) {
+			t.Errorf("readFrame %x/%d = %x/%d %v", test.flags, len(test.body), flags, len(body), err)
+		}
+	}
+	huge := &zmqReq{rd: bufio.NewReader(bytes.NewReader([]byte{0x02, 0, 0, 0, 0, 1, 0, 0, 0}))}
+	if _, _, err := huge.readFrame(); err == nil {
+		t.Error("oversized frame accepted")
+	}
+}
+
+// 只写入缓冲区的连接
+type bufConn struct {
+	net.Conn
+	buf *bytes.Buffer
+}
+
+func (c *bufConn) Write(b []byte) (int, error) { return c.buf.Write(b) }